@@ -0,0 +1,367 @@
+// buggy-ca issues and manages certificates of buggy-server and buggy-client
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+const usage = `Usage: buggy-ca <command> [options]
+
+Commands:
+  init     create root CA rootCA.pem and rootCA.key
+  server   issue server.pem and server.key
+  client   issue client.pem and client.key, or <name>.pem and <name>.key
+  renew    reissue a cert with the same subject and key
+  revoke   revoke a cert by name or serial number, and update crl.pem
+  crl      re-sign crl.pem to extend its validity
+  expiry   print expiry dates of certs and crl.pem
+
+Run buggy-ca <command> -h for options of a command.
+`
+
+var ErrExists = errors.New("File exists, use -force to overwrite")
+
+// list is a comma separated flag value
+type list []string
+
+func (self *list) String() string {
+	return strings.Join(*self, ",")
+}
+
+func (self *list) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*self = append(*self, v)
+		}
+	}
+	return nil
+}
+
+func newFlagSet(name string, args string) (*flag.FlagSet, *PKI) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: buggy-ca %s [options] %s\n", name, args)
+		flags.PrintDefaults()
+	}
+
+	pki := &PKI{}
+	flags.StringVar(&pki.Dir, "dir", "/etc/buggy", "directory of certs and keys")
+	return flags, pki
+}
+
+func printCert(file string, cert *x509.Certificate) {
+	fmt.Printf("%s: subject %s, serial %s, expires %s\n",
+		file, cert.Subject, cert.SerialNumber.Text(16), cert.NotAfter.Format(time.RFC3339))
+}
+
+func runInit(args []string) error {
+	flags, pki := newFlagSet("init", "")
+	commonName := flags.String("cn", "buggy root CA", "common name")
+	days := flags.Int("days", 3650, "validity in days")
+	force := flags.Bool("force", false, "overwrite existing root CA, which invalidates all certs issued")
+	flags.Parse(args)
+
+	if pki.Exists("rootCA") && !*force {
+		return ErrExists
+	}
+
+	if err := os.MkdirAll(pki.Dir, 0755); err != nil {
+		return err
+	}
+
+	cert, err := pki.InitCA(*commonName, time.Duration(*days)*day)
+	if err != nil {
+		return err
+	}
+
+	printCert("rootCA.pem", cert)
+	return nil
+}
+
+func runServer(args []string) error {
+	flags, pki := newFlagSet("server", "")
+	var dnsNames, ips list
+	flags.Var(&dnsNames, "dns", "DNS names, comma separated")
+	flags.Var(&ips, "ip", "IP addresses, comma separated")
+	commonName := flags.String("cn", "", "common name. Default to the first DNS name")
+	days := flags.Int("days", 90, "validity in days")
+	force := flags.Bool("force", false, "overwrite existing cert")
+	flags.Parse(args)
+
+	if len(dnsNames) == 0 && len(ips) == 0 {
+		return errors.New("At least one of -dns or -ip is required")
+	}
+
+	if pki.Exists("server") && !*force {
+		return ErrExists
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: *commonName},
+		DNSNames:    dnsNames,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	if template.Subject.CommonName == "" && len(dnsNames) > 0 {
+		template.Subject.CommonName = dnsNames[0]
+	}
+
+	for _, v := range ips {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return fmt.Errorf("Invalid IP address %s", v)
+		}
+		template.IPAddresses = append(template.IPAddresses, ip)
+	}
+
+	cert, err := pki.Issue("server", template, nil, time.Duration(*days)*day)
+	if err != nil {
+		return err
+	}
+
+	printCert("server.pem", cert)
+	return nil
+}
+
+func runClient(args []string) error {
+	flags, pki := newFlagSet("client", "")
+	var uris, dnsNames, emails list
+	commonName := flags.String("cn", "", "common name, which identifies the client when it has no spiffe URI")
+	flags.Var(&uris, "uri", "URIs, comma separated, e.g. spiffe://example.org/team-a")
+	flags.Var(&dnsNames, "dns", "DNS names, comma separated")
+	flags.Var(&emails, "email", "email addresses, comma separated")
+	name := flags.String("name", "client", "file name of cert and key, without extension")
+	days := flags.Int("days", 90, "validity in days")
+	force := flags.Bool("force", false, "overwrite existing cert")
+	flags.Parse(args)
+
+	if *commonName == "" && len(uris) == 0 {
+		return errors.New("At least one of -cn or -uri is required")
+	}
+
+	if pki.Exists(*name) && !*force {
+		return ErrExists
+	}
+
+	template := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: *commonName},
+		DNSNames:       dnsNames,
+		EmailAddresses: emails,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, v := range uris {
+		uri, err := url.Parse(v)
+		if err != nil {
+			return err
+		}
+		template.URIs = append(template.URIs, uri)
+	}
+
+	cert, err := pki.Issue(*name, template, nil, time.Duration(*days)*day)
+	if err != nil {
+		return err
+	}
+
+	printCert(*name+".pem", cert)
+	return nil
+}
+
+func runRenew(args []string) error {
+	flags, pki := newFlagSet("renew", "<name>")
+	days := flags.Int("days", 90, "validity in days")
+	rekey := flags.Bool("rekey", false, "generate a new key")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	name := strings.TrimSuffix(flags.Arg(0), ".pem")
+	if name == "rootCA" {
+		return errors.New("Root CA cannot be renewed, run init -force instead")
+	}
+
+	old, err := pki.LoadCert(name)
+	if err != nil {
+		return err
+	}
+
+	key, err := pki.LoadKey(name)
+	if err != nil {
+		return err
+	}
+
+	if *rekey {
+		key = nil
+	}
+
+	template := &x509.Certificate{
+		Subject:        old.Subject,
+		DNSNames:       old.DNSNames,
+		IPAddresses:    old.IPAddresses,
+		URIs:           old.URIs,
+		EmailAddresses: old.EmailAddresses,
+		ExtKeyUsage:    old.ExtKeyUsage,
+	}
+
+	cert, err := pki.Issue(name, template, key, time.Duration(*days)*day)
+	if err != nil {
+		return err
+	}
+
+	printCert(name+".pem", cert)
+	return nil
+}
+
+func runRevoke(args []string) error {
+	flags, pki := newFlagSet("revoke", "<name or hex serial>...")
+	days := flags.Int("days", 30, "validity of crl.pem in days")
+	reason := flags.Int("reason", 0, "CRL reason code, e.g. 1 for key compromise")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var serials []*big.Int
+	for _, arg := range flags.Args() {
+		name := strings.TrimSuffix(arg, ".pem")
+		if pki.Exists(name) {
+			cert, err := pki.LoadCert(name)
+			if err != nil {
+				return err
+			}
+			serials = append(serials, cert.SerialNumber)
+			continue
+		}
+
+		serial, ok := new(big.Int).SetString(strings.ReplaceAll(arg, ":", ""), 16)
+		if !ok {
+			return fmt.Errorf("%s is neither a cert name nor a hex serial", arg)
+		}
+		serials = append(serials, serial)
+	}
+
+	crl, err := pki.SignCrl(time.Duration(*days)*day, *reason, serials...)
+	if err != nil {
+		return err
+	}
+
+	for _, serial := range serials {
+		fmt.Printf("revoked serial %s\n", serial.Text(16))
+	}
+	fmt.Printf("crl.pem: %d revoked, next update %s\n", len(crl.RevokedCertificateEntries), crl.NextUpdate.Format(time.RFC3339))
+	return nil
+}
+
+func runCrl(args []string) error {
+	flags, pki := newFlagSet("crl", "")
+	days := flags.Int("days", 30, "validity of crl.pem in days")
+	flags.Parse(args)
+
+	crl, err := pki.SignCrl(time.Duration(*days)*day, 0)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("crl.pem: %d revoked, next update %s\n", len(crl.RevokedCertificateEntries), crl.NextUpdate.Format(time.RFC3339))
+	return nil
+}
+
+func runExpiry(args []string) error {
+	flags, pki := newFlagSet("expiry", "[name]...")
+	flags.Parse(args)
+
+	names := flags.Args()
+	if len(names) == 0 {
+		files, err := filepath.Glob(filepath.Join(pki.Dir, "*.pem"))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			if name := strings.TrimSuffix(filepath.Base(file), ".pem"); name != "crl" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	now := time.Now()
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".pem")
+		cert, err := pki.LoadCert(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s.pem: %s\n", name, err)
+			continue
+		}
+
+		status := fmt.Sprintf("%d days left", int(cert.NotAfter.Sub(now)/day))
+		if now.After(cert.NotAfter) {
+			status = "EXPIRED"
+		}
+
+		fmt.Printf("%-20s %s  %s  %s\n", name+".pem", cert.NotAfter.Format(time.RFC3339), status, cert.Subject)
+	}
+
+	crl, err := pki.LoadCrl()
+	if err != nil {
+		return err
+	}
+
+	if crl != nil {
+		status := fmt.Sprintf("%d days left", int(crl.NextUpdate.Sub(now)/day))
+		if now.After(crl.NextUpdate) {
+			status = "EXPIRED"
+		}
+
+		fmt.Printf("%-20s %s  %s  %d revoked\n", "crl.pem", crl.NextUpdate.Format(time.RFC3339), status, len(crl.RevokedCertificateEntries))
+	}
+
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	commands := map[string]func([]string) error{
+		"init":   runInit,
+		"server": runServer,
+		"client": runClient,
+		"renew":  runRenew,
+		"revoke": runRevoke,
+		"crl":    runCrl,
+		"expiry": runExpiry,
+	}
+
+	command, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err := command(os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
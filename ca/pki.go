@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var ErrNotPemCertificate = errors.New("No PEM certificate found")
+var ErrNotPemKey = errors.New("No PEM private key found")
+
+// clock skew allowance for NotBefore
+const backdate = 5 * time.Minute
+
+// PKI is a directory of PEM files, in the layout buggy-server and buggy-client expect:
+//
+//	rootCA.pem rootCA.key  root CA
+//	server.pem server.key  server cert
+//	client.pem client.key  client cert, or <name>.pem <name>.key for more clients
+//	crl.pem                revoked certs
+type PKI struct {
+	Dir string
+}
+
+func (self *PKI) path(name string, ext string) string {
+	return filepath.Join(self.Dir, name+ext)
+}
+
+// writeFile replaces file atomically, so reloading servers never see a partial file
+func writeFile(file string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Chmod(perm)
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func (self *PKI) Exists(name string) bool {
+	_, err := os.Stat(self.path(name, ".pem"))
+	return err == nil
+}
+
+func (self *PKI) LoadCert(name string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(self.path(name, ".pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, ErrNotPemCertificate
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func (self *PKI) LoadKey(name string) (crypto.Signer, error) {
+	data, err := os.ReadFile(self.path(name, ".key"))
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, ErrNotPemKey
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, err
+		}
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, ErrNotPemKey
+	}
+
+	return signer, nil
+}
+
+func (self *PKI) SaveKey(name string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(self.path(name, ".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+}
+
+func (self *PKI) SaveCert(name string, der []byte) error {
+	return writeFile(self.path(name, ".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func NewKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// Issue signs template for key with the root CA, and saves both as name.
+// key is generated if nil.
+func (self *PKI) Issue(name string, template *x509.Certificate, key crypto.Signer, validity time.Duration) (*x509.Certificate, error) {
+	ca, err := self.LoadCert("rootCA")
+	if err != nil {
+		return nil, err
+	}
+
+	caKey, err := self.LoadKey("rootCA")
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		if key, err = NewKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	if template.SerialNumber, err = newSerial(); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template.NotBefore = now.Add(-backdate)
+	template.NotAfter = now.Add(validity)
+	if template.NotAfter.After(ca.NotAfter) {
+		template.NotAfter = ca.NotAfter
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = self.SaveKey(name, key); err != nil {
+		return nil, err
+	}
+
+	if err = self.SaveCert(name, der); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// InitCA creates a self signed root CA
+func (self *PKI) InitCA(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	key, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             now.Add(-backdate),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = self.SaveKey("rootCA", key); err != nil {
+		return nil, err
+	}
+
+	if err = self.SaveCert("rootCA", der); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseCertificate(der)
+}
+
+// LoadCrl returns the current CRL, or nil if there is none yet
+func (self *PKI) LoadCrl() (*x509.RevocationList, error) {
+	data, err := os.ReadFile(self.path("crl", ".pem"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, errors.New("No PEM CRL found")
+	}
+
+	return x509.ParseRevocationList(block.Bytes)
+}
+
+// SignCrl writes crl.pem with entries revoked so far, plus serials if given
+func (self *PKI) SignCrl(validity time.Duration, reason int, serials ...*big.Int) (*x509.RevocationList, error) {
+	ca, err := self.LoadCert("rootCA")
+	if err != nil {
+		return nil, err
+	}
+
+	caKey, err := self.LoadKey("rootCA")
+	if err != nil {
+		return nil, err
+	}
+
+	old, err := self.LoadCrl()
+	if err != nil {
+		return nil, err
+	}
+
+	number := big.NewInt(1)
+	var entries []x509.RevocationListEntry
+	if old != nil {
+		number.Add(old.Number, number)
+		entries = old.RevokedCertificateEntries
+	}
+
+	now := time.Now()
+	for _, serial := range serials {
+		revoked := false
+		for _, entry := range entries {
+			if entry.SerialNumber.Cmp(serial) == 0 {
+				revoked = true
+				break
+			}
+		}
+
+		if !revoked {
+			entries = append(entries, x509.RevocationListEntry{
+				SerialNumber:   serial,
+				RevocationTime: now,
+				ReasonCode:     reason,
+			})
+		}
+	}
+
+	template := &x509.RevocationList{
+		Number:                    number,
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(validity),
+		RevokedCertificateEntries: entries,
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = writeFile(self.path("crl", ".pem"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), 0644); err != nil {
+		return nil, err
+	}
+
+	return x509.ParseRevocationList(der)
+}
@@ -1,9 +1,60 @@
 package main
 
+import "time"
+
 type Config struct {
+	// ListenAddr serves local apps by Mode. Empty to only serve Forwards and Reverses.
 	ListenAddr string `env:"LISTEN_ADDR"`
+	// Forwards is a comma separated list of local_addr->host:port, each forwarding a local port to a fixed destination over the tunnel
+	Forwards string `env:"FORWARDS"`
+	// Reverses is a comma separated list of remote_port_or_host->host:port, each exposing a local service
+	// through buggy-server. The client identity must be allowed to bind the port or host name.
+	Reverses   string `env:"REVERSES"`
 	RootCA     string `env:"ROOT_CA"`
 	ClientCert string `env:"CLIENT_CERT" default:"/etc/buggy/client.pem"`
 	ClientKey  string `env:"CLIENT_KEY" default:"/etc/buggy/client.key"`
-	RemoteUrl  string `env:"REMOTE_URL"`
+	// RemoteUrl is a comma separated list of buggy-server urls
+	RemoteUrl string `env:"REMOTE_URL"`
+	// UpstreamStrategy picks a server of RemoteUrl: failover, round-robin, least-connections or lowest-latency
+	UpstreamStrategy string `env:"UPSTREAM_STRATEGY" default:"failover"`
+	// UpstreamMaxBackoff caps the interval of health checks on failed servers
+	UpstreamMaxBackoff time.Duration `env:"UPSTREAM_MAX_BACKOFF" default:"1m"`
+	// CertReloadInterval is how often cert, key and CA files are checked for change. 0 to only reload on SIGHUP.
+	CertReloadInterval time.Duration `env:"CERT_RELOAD_INTERVAL" default:"30s"`
+	// Mode is the protocol spoken by local apps: raw, socks5, http, or transparent for connections
+	// diverted by iptables REDIRECT, or TPROXY if Tproxy is set. Linux only. Exclude the traffic of
+	// buggy-client itself from the iptables rules, e.g. with -m owner ! --uid-owner.
+	Mode string `env:"MODE" default:"raw"`
+	// Tproxy takes destinations of transparent mode from TPROXY rather than REDIRECT. Requires CAP_NET_ADMIN.
+	Tproxy        bool   `env:"TPROXY"`
+	SocksUser     string `env:"SOCKS_USER"`
+	SocksPassword string `env:"SOCKS_PASSWORD"`
+	// ProxyUser and ProxyPassword require Basic Proxy-Authorization in http mode. Empty to allow all.
+	ProxyUser     string `env:"PROXY_USER"`
+	ProxyPassword string `env:"PROXY_PASSWORD"`
+	// DnsListenAddr serves DNS over UDP and TCP, forwarding queries through the tunnel to DnsUpstream. Empty to disable.
+	DnsListenAddr string `env:"DNS_LISTEN_ADDR"`
+	// DnsUpstream is host:port of the resolver buggy-server dials over TCP for queries of DnsListenAddr
+	DnsUpstream string `env:"DNS_UPSTREAM" default:"1.1.1.1:53"`
+	// DnsCacheSize is the max number of responses cached by their TTL. 0 to disable the cache.
+	DnsCacheSize int `env:"DNS_CACHE_SIZE" default:"4096"`
+	// DnsTimeout limits the time to answer a query through the tunnel
+	DnsTimeout time.Duration `env:"DNS_TIMEOUT" default:"5s"`
+	// RoutesFile lists rules to send destinations through the tunnel, direct or reject them. Empty sends all through the tunnel.
+	RoutesFile string `env:"ROUTES_FILE"`
+	// Mux carries all local connections over one TLS connection, if buggy-server supports it
+	Mux          bool          `env:"MUX"`
+	MuxKeepAlive time.Duration `env:"MUX_KEEPALIVE" default:"30s"`
+	// Timeouts. 0 for no limit.
+	DialTimeout      time.Duration `env:"DIAL_TIMEOUT" default:"10s"`
+	HandshakeTimeout time.Duration `env:"HANDSHAKE_TIMEOUT" default:"10s"`
+	HeaderTimeout    time.Duration `env:"HEADER_TIMEOUT" default:"30s"`
+	IdleTimeout      time.Duration `env:"IDLE_TIMEOUT"`
+	MaxLifetime      time.Duration `env:"MAX_LIFETIME"`
+	// UdpIdleTimeout ends UDP flows of SOCKS5 UDP ASSOCIATE idle for this long. 0 to keep them while the association lasts.
+	UdpIdleTimeout time.Duration `env:"UDP_IDLE_TIMEOUT" default:"1m"`
+	// DrainTimeout is how long connections may carry on after shutdown is signalled, before they are reset
+	DrainTimeout time.Duration `env:"DRAIN_TIMEOUT" default:"30s"`
+	// MetricsAddr serves Prometheus metrics at /metrics. Empty to disable.
+	MetricsAddr string `env:"METRICS_ADDR"`
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/dns"
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+var ErrDnsTimeout = errors.New("DNS query timed out")
+var ErrDnsIdMismatch = errors.New("DNS response does not match query")
+
+// DnsForwarder answers DNS queries of local apps by a resolver dialed by buggy-server, so that lookups do not
+// leak from the local network. Each query goes over its own tunnel connection, which is cheap with Mux.
+type DnsForwarder struct {
+	Upstreams *Upstreams
+	// Resolver is host:port of the DNS server, dialed over TCP by buggy-server
+	Resolver string
+	// Cache is nil to forward every query
+	Cache *dns.Cache
+	// Timeout limits the time to answer a query through the tunnel
+	Timeout time.Duration
+	// HeaderTimeout limits the wait for the next query of a local DNS over TCP connection
+	HeaderTimeout time.Duration
+	Metrics       *Metrics
+}
+
+// exchange sends query to the resolver through the tunnel, and returns its response
+func (self *DnsForwarder) exchange(query []byte) (response []byte, err error) {
+	up, err := self.Upstreams.Connect(self.Resolver)
+	if err != nil {
+		return
+	}
+
+	defer up.Close()
+
+	err = tcp.RunWithTimeout(up, self.Timeout, ErrDnsTimeout, func() (err error) {
+		if err = dns.WriteTcp(up, query); err != nil {
+			return
+		}
+
+		if err = up.Flush(); err != nil {
+			return
+		}
+
+		response, err = dns.ReadTcp(up)
+		return
+	})
+
+	if err == nil && dns.ID(response) != dns.ID(query) {
+		err = ErrDnsIdMismatch
+	}
+	return
+}
+
+// Resolve answers query from the cache or the resolver. Failures are answered with SERVFAIL, and err is set
+// for logging.
+func (self *DnsForwarder) Resolve(query []byte) (response []byte, err error) {
+	if _, _, err = dns.ParseQuestion(query); err != nil {
+		// not worth an answer
+		self.Metrics.DnsQueries.With("malformed").Inc()
+		return
+	}
+
+	if self.Cache != nil {
+		if response = self.Cache.Get(query); response != nil {
+			self.Metrics.DnsQueries.With("hit").Inc()
+			return
+		}
+	}
+
+	if response, err = self.exchange(query); err != nil {
+		self.Metrics.DnsQueries.With("error").Inc()
+		response, _ = dns.ServerFailure(query)
+		return
+	}
+
+	self.Metrics.DnsQueries.With("miss").Inc()
+	if self.Cache != nil {
+		self.Cache.Put(query, response)
+	}
+	return
+}
+
+// HandleTcp answers queries of a local DNS over TCP connection until it is closed
+func (self *DnsForwarder) HandleTcp(conn tcp.Conn, logger log.Logger) error {
+	for {
+		var query []byte
+		err := tcp.RunWithTimeout(conn, self.HeaderTimeout, tcp.ErrIdleTimeout, func() (err error) {
+			query, err = dns.ReadTcp(conn)
+			return
+		})
+
+		if err == io.EOF || err == tcp.ErrIdleTimeout {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		response, err := self.Resolve(query)
+		if err != nil {
+			logger.Warn().Value("error", err.Error()).Msg("DNS query failed")
+		}
+
+		if response == nil {
+			continue
+		}
+
+		if err = dns.WriteTcp(conn, response); err != nil {
+			return err
+		}
+
+		if err = conn.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// ServeUdp answers DNS queries over UDP on conn until ctx is done
+func (self *DnsForwarder) ServeUdp(ctx context.Context, conn *net.UDPConn, logger log.Logger) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, tcp.MaxDatagramSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Err().Error(0, err)
+			}
+			return
+		}
+
+		go func(query []byte, from *net.UDPAddr) {
+			response, err := self.Resolve(query)
+			if err != nil {
+				logger.Warn().Value("client_ip", from.String()).Value("error", err.Error()).Msg("DNS query failed")
+			}
+
+			if response != nil {
+				conn.WriteToUDP(dns.Truncate(response, dns.UdpSize(query)), from)
+			}
+		}(append([]byte{}, buf[:n]...), from)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+// Forward maps a local listen address to a fixed destination reached over the tunnel
+type Forward struct {
+	Listen string
+	Target string
+}
+
+// ParseForwards parses a comma separated list of local_listen_addr->remote_host:port, e.g.
+//
+//	127.0.0.1:5432->db.internal:5432,127.0.0.1:6379->cache.internal:6379
+func ParseForwards(s string) (ret []Forward, err error) {
+	for _, mapping := range strings.Split(s, ",") {
+		if mapping = strings.TrimSpace(mapping); mapping == "" {
+			continue
+		}
+
+		listen, target, ok := strings.Cut(mapping, "->")
+		if !ok {
+			return nil, fmt.Errorf("Malformed forward %s, expecting local_addr->host:port", mapping)
+		}
+
+		forward := Forward{Listen: strings.TrimSpace(listen), Target: strings.TrimSpace(target)}
+		if _, _, err = net.SplitHostPort(forward.Listen); err != nil {
+			return nil, fmt.Errorf("Malformed forward %s: %w", mapping, err)
+		}
+		if _, _, err = net.SplitHostPort(forward.Target); err != nil {
+			return nil, fmt.Errorf("Malformed forward %s: %w", mapping, err)
+		}
+
+		ret = append(ret, forward)
+	}
+	return
+}
+
+// HandleForward splices conn with target over the tunnel, for local apps unable to use a proxy
+func (self *Handler) HandleForward(target string) HandleFunc {
+	return func(conn tcp.Conn, logger log.Logger) error {
+		// the 200 response is consumed by Connect
+		up, err := self.Upstreams.Connect(target)
+		if err != nil {
+			return err
+		}
+
+		defer up.Close()
+
+		return self.splice(conn, up, target, logger)
+	}
+}
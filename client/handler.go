@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+// HandleFunc serves a local connection
+type HandleFunc func(conn tcp.Conn, logger log.Logger) error
+
+// Handler serves local connections over the tunnel
+type Handler struct {
+	Upstreams *Upstreams
+	// Router picks the route of destinations known from the request of local apps
+	Router *Router
+	// Dialer dials destinations routed direct
+	Dialer    *tcp.TcpDialer
+	SocksAuth *Credentials
+	// HttpAuth is checked against Proxy-Authorization in http mode
+	HttpAuth *Credentials
+	// HeaderTimeout limits the time to read the request of local apps
+	HeaderTimeout time.Duration
+	// UdpIdleTimeout ends UDP flows of SOCKS5 UDP ASSOCIATE with no datagram in either direction
+	UdpIdleTimeout time.Duration
+	Splice         tcp.SpliceOptions
+	Metrics        *Metrics
+}
+
+// splice copies between local conn and tunnel up, and logs and counts the traffic when done
+func (self *Handler) splice(conn tcp.Conn, up tcp.Conn, target string, logger log.Logger) error {
+	stats, err := tcp.SpliceWithOptions(conn, up, self.Splice)
+	self.logStats(&stats, target, logger)
+	return err
+}
+
+// logStats logs and counts traffic of a local connection, where dst of stats is the local app
+func (self *Handler) logStats(stats *tcp.SpliceStats, target string, logger log.Logger) {
+	self.Metrics.addStats(stats)
+
+	closedFirst := "local"
+	if stats.SrcClosedFirst {
+		closedFirst = "tunnel"
+	}
+
+	entry := logger.Info().
+		Value("bytes_up", stats.DstToSrc).
+		Value("bytes_down", stats.SrcToDst).
+		Value("duration_ms", stats.Duration.Milliseconds()).
+		Value("closed_first", closedFirst)
+
+	if target != "" {
+		entry = entry.Value("target", target)
+	}
+
+	if stats.DstToSrcErr != nil {
+		entry = entry.Value("error_up", stats.DstToSrcErr.Error())
+	}
+
+	if stats.SrcToDstErr != nil {
+		entry = entry.Value("error_down", stats.SrcToDstErr.Error())
+	}
+
+	entry.Msg("Connection closed")
+}
+
+// connect opens a connection to host:port target by its route
+func (self *Handler) connect(target string) (tcp.Conn, Route, error) {
+	route, err := self.Router.Route(target)
+	if err != nil {
+		return nil, route, err
+	}
+
+	switch route {
+	case RouteReject:
+		return nil, route, ErrRouteRejected
+	case RouteDirect:
+		conn, err := self.Dialer.Dial(target)
+		if err != nil {
+			return nil, route, err
+		}
+		return conn, route, nil
+	}
+
+	conn, err := self.Upstreams.Connect(target)
+	return conn, route, err
+}
+
+// HandleRaw splices conn with a tunnel connection, for local apps speaking to buggy-server directly
+func (self *Handler) HandleRaw(conn tcp.Conn, logger log.Logger) error {
+	up, err := self.Upstreams.Open()
+	if err != nil {
+		return err
+	}
+
+	defer up.Close()
+
+	return self.splice(conn, up, "", logger)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/z-george-ma/buggy/v2/lib"
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+var ErrHttpNotAbsoluteUrl = errors.New("Request target is not an absolute http url")
+var ErrProxyAuthRequired = errors.New("Proxy authentication required")
+
+var connectEstablished = []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+
+// proxyAuthorized checks Basic credentials of Proxy-Authorization header value
+func proxyAuthorized(auth *Credentials, header string) bool {
+	if auth == nil {
+		return true
+	}
+
+	scheme, encoded, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "basic") {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+
+	username, password, _ := strings.Cut(lib.BytesToString(decoded), ":")
+	return auth.Match([]byte(username), []byte(password))
+}
+
+// requestTarget returns host:port of the destination of request
+func requestTarget(request *tcp.HttpRequest) (string, error) {
+	if request.Method == "CONNECT" {
+		if _, _, err := net.SplitHostPort(request.Url); err != nil {
+			return "", err
+		}
+		return request.Url, nil
+	}
+
+	u, err := url.Parse(request.Url)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return "", ErrHttpNotAbsoluteUrl
+	}
+
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	}
+
+	return u.Host, nil
+}
+
+// toOriginForm rewrites an absolute url request to be sent to the origin server
+func toOriginForm(request *tcp.HttpRequest) {
+	u, _ := url.Parse(request.Url)
+	request.Headers["host"] = u.Host
+
+	request.Url = u.RequestURI()
+}
+
+// writeHttpError answers the local app with the error of opening a connection to its destination
+func writeHttpError(conn tcp.Conn, err error) error {
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		// relay the answer of buggy-server
+		response := connectErr.Response
+		response.Headers["content-length"] = strconv.Itoa(len(connectErr.Body))
+		response.Headers["connection"] = "close"
+		delete(response.Headers, "transfer-encoding")
+
+		if err = tcp.WriteHttpResponse(conn, &response); err != nil {
+			return err
+		}
+
+		if _, err = conn.Write(connectErr.Body); err != nil {
+			return err
+		}
+
+		return conn.Flush()
+	}
+
+	statusCode, errorType := 502, "destination_unavailable"
+
+	var netErr net.Error
+	switch {
+	case err == ErrProxyAuthRequired:
+		return tcp.WriteHttpStatus(conn, 407, map[string]string{
+			"proxy-authenticate": `Basic realm="buggy"`,
+		}, "proxy_authentication_required\n")
+	case err == ErrRouteRejected:
+		statusCode, errorType = 403, "http_request_denied"
+	case err == ErrHttpNotAbsoluteUrl, err == tcp.ErrHttpMalformedHeader, err == tcp.ErrExceedingHeaderCount, err == bufio.ErrBufferFull:
+		statusCode, errorType = 400, "http_request_error"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		statusCode, errorType = 504, "connection_timeout"
+	}
+
+	return tcp.WriteHttpStatus(conn, statusCode, map[string]string{
+		"proxy-status": "buggy-client; error=" + errorType,
+	}, errorType+"\n")
+}
+
+// HandleHttp serves a request of a local app speaking HTTP proxy protocol. CONNECT is spliced with
+// the destination. Other requests are replayed to the destination, and the connection is closed after the response.
+func (self *Handler) HandleHttp(conn tcp.Conn, logger log.Logger) (err error) {
+	var request tcp.HttpRequest
+	err = tcp.RunWithTimeout(conn, self.HeaderTimeout, tcp.ErrHeaderTimeout, func() (err error) {
+		request, err = tcp.ParseHttpRequest(conn)
+		return
+	})
+
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF && err != tcp.ErrHeaderTimeout {
+			writeHttpError(conn, err)
+		}
+		return
+	}
+
+	if !proxyAuthorized(self.HttpAuth, request.Headers["proxy-authorization"]) {
+		err = ErrProxyAuthRequired
+		writeHttpError(conn, err)
+		return
+	}
+
+	delete(request.Headers, "proxy-authorization")
+
+	target, err := requestTarget(&request)
+	if err != nil {
+		writeHttpError(conn, err)
+		return
+	}
+
+	logger = logger.With().Value("method", request.Method).Logger()
+
+	if request.Method == "CONNECT" {
+		up, route, err := self.connect(target)
+		if err != nil {
+			writeHttpError(conn, err)
+			return err
+		}
+
+		defer up.Close()
+
+		if _, err = conn.Write(connectEstablished); err != nil {
+			return err
+		}
+
+		if err = conn.Flush(); err != nil {
+			return err
+		}
+
+		return self.splice(conn, up, target, logger.With().Value("route", route.String()).Logger())
+	}
+
+	route, err := self.Router.Route(target)
+	if err != nil {
+		writeHttpError(conn, err)
+		return
+	}
+
+	var up tcp.Conn
+	switch route {
+	case RouteReject:
+		err = ErrRouteRejected
+	case RouteDirect:
+		toOriginForm(&request)
+		up, err = self.Dialer.Dial(target)
+	default:
+		// buggy-server forwards absolute url requests
+		up, err = self.Upstreams.Open()
+	}
+
+	if err != nil {
+		writeHttpError(conn, err)
+		return
+	}
+
+	defer up.Close()
+
+	// one request per connection, so every request is routed and logged
+	request.Headers["connection"] = "close"
+	delete(request.Headers, "proxy-connection")
+	delete(request.Headers, "keep-alive")
+
+	if err = tcp.WriteHttpRequest(up, &request); err != nil {
+		return
+	}
+
+	if err = up.Flush(); err != nil {
+		return
+	}
+
+	return self.splice(conn, up, target, logger.With().Value("route", route.String()).Logger())
+}
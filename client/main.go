@@ -3,16 +3,24 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	stdlog "log"
 
 	"github.com/z-george-ma/buggy/v2/conf"
+	"github.com/z-george-ma/buggy/v2/dns"
 	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/metrics"
 	"github.com/z-george-ma/buggy/v2/tcp"
 )
 
@@ -34,79 +42,296 @@ func main() {
 
 	config := conf.LoadConfig[Config]()
 
-	serverAddr, err := tcp.UrlToAddress(config.RemoteUrl)
+	stdio := flag.String("stdio", "", "splice stdin and stdout with `host:port` over the tunnel, e.g. as ssh ProxyCommand")
+	flag.Parse()
 
+	var serverAddrs []tcp.NetworkAddress
+	for _, remoteUrl := range strings.Split(config.RemoteUrl, ",") {
+		serverAddr, err := tcp.UrlToAddress(strings.TrimSpace(remoteUrl))
+		if err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+		serverAddrs = append(serverAddrs, serverAddr)
+	}
+
+	sig, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM) // alloc
+
+	certs, err := tcp.NewCertStore(config.ClientCert, config.ClientKey, config.RootCA)
 	if err != nil {
 		log.Err().Error(0, err)
 		return
 	}
 
-	sig, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM) // alloc
+	onReload := func(err error) {
+		if err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+		log.Info().Value("not_after", certs.Leaf().NotAfter.String()).Msg("Certificates reloaded")
+	}
 
-	server := tcp.NewServer(true, 8192, 0, func(err error) bool {
-		if _, ok := err.(*net.OpError); ok {
-			// accept deadline reached
-			cancel()
-			return true
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			onReload(certs.Reload())
 		}
+	}()
 
-		log.Err().Error(1, err)
-		return false
-	})
+	if config.CertReloadInterval > 0 {
+		go certs.Watch(sig, config.CertReloadInterval, onReload)
+	}
 
-	var rootCAs *x509.CertPool
-	if config.RootCA != "" {
-		rootCAs = x509.NewCertPool()
-		cert, err := os.ReadFile(config.RootCA)
+	clientMetrics := NewMetrics()
+	if config.MetricsAddr != "" {
+		metricsServer, err := metrics.Serve(config.MetricsAddr, clientMetrics.Registry)
 		if err != nil {
 			log.Err().Error(0, err)
 			return
 		}
-		rootCAs.AppendCertsFromPEM(cert)
+		defer metricsServer.Close()
+	}
+
+	tcpDialer := tcp.NewDialer(true, 8192, 8192)
+	tcpDialer.Dialer.Timeout = config.DialTimeout
+	tcpDialer.Hooks = clientMetrics.DialerHooks()
+
+	tunnelOptions := TunnelOptions{
+		Mux:              config.Mux,
+		MuxKeepAlive:     config.MuxKeepAlive,
+		HandshakeTimeout: config.HandshakeTimeout,
+		HeaderTimeout:    config.HeaderTimeout,
+		Metrics:          clientMetrics,
+	}
+
+	var tunnels []*Tunnel
+	for _, serverAddr := range serverAddrs {
+		tlsConfig := &tls.Config{
+			ServerName: serverAddr.Host,
+		}
+
+		tunnels = append(tunnels, NewTunnel(tcpDialer, serverAddr.Address, func() *tls.Config {
+			return certs.ClientConfig(tlsConfig)
+		}, tunnelOptions))
 	}
 
-	certs, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+	upstreams, err := NewUpstreams(tunnels, config.UpstreamStrategy, config.UpstreamMaxBackoff, log)
 	if err != nil {
 		log.Err().Error(0, err)
 		return
 	}
 
-	tlsConfig := tls.Config{
-		ServerName:   serverAddr.Host,
-		Certificates: []tls.Certificate{certs},
-		RootCAs:      rootCAs,
+	var router *Router
+	if config.RoutesFile != "" {
+		if router, err = LoadRouter(config.RoutesFile); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
 	}
 
-	tcpDialer := tcp.NewDialer(true, 8192, 8192)
+	directDialer := tcp.NewDialer(true, 8192, 8192)
+	directDialer.Dialer.Timeout = config.DialTimeout
 
-	server.OnConnect(func(ctx context.Context, tc *tcp.TcpConn) {
-		defer tc.Close()
-		connLog := log.With().Value("client_ip", tc.TCPConn.RemoteAddr().String()).Logger()
-		down, err := tcpDialer.Dial(serverAddr.Address)
+	handler := &Handler{
+		Upstreams:      upstreams,
+		Router:         router,
+		Dialer:         directDialer,
+		HeaderTimeout:  config.HeaderTimeout,
+		UdpIdleTimeout: config.UdpIdleTimeout,
+		Splice: tcp.SpliceOptions{
+			IdleTimeout: config.IdleTimeout,
+			MaxLifetime: config.MaxLifetime,
+		},
+		Metrics: clientMetrics,
+	}
 
-		if err != nil {
-			connLog.Err().Error(0, err)
-			return
+	if config.SocksUser != "" {
+		handler.SocksAuth = &Credentials{
+			Username: config.SocksUser,
+			Password: config.SocksPassword,
 		}
+	}
 
-		defer down.Close()
+	if config.ProxyUser != "" {
+		handler.HttpAuth = &Credentials{
+			Username: config.ProxyUser,
+			Password: config.ProxyPassword,
+		}
+	}
 
-		tls := tcp.TlsConnect(down, &tlsConfig)
+	if *stdio != "" {
+		conn := tcp.NewStdioConn(os.Stdin, os.Stdout, 8192, 8192)
+		defer conn.Close()
 
-		err = tcp.Splice(tc, tls)
-		if err != nil {
-			connLog.Err().Error(0, err)
-			return
+		if err := handler.HandleForward(*stdio)(conn, log); err != nil {
+			log.Err().Error(0, err)
 		}
-	})
+		return
+	}
+
+	handle := HandleFunc(handler.HandleRaw)
+	switch config.Mode {
+	case "raw":
+	case "socks5":
+		handle = handler.HandleSocks
+	case "http":
+		handle = handler.HandleHttp
+	case "transparent":
+		handle = handler.HandleTransparent(config.Tproxy, config.ListenAddr)
+	default:
+		log.Err().Error(0, fmt.Errorf("Unknown mode %s", config.Mode))
+		return
+	}
+
+	forwards, err := ParseForwards(config.Forwards)
+	if err != nil {
+		log.Err().Error(0, err)
+		return
+	}
 
-	err = server.Start(context.Background(), "tcp", config.ListenAddr)
+	reverses, err := ParseReverses(config.Reverses)
 	if err != nil {
 		log.Err().Error(0, err)
 		return
 	}
-	defer server.Close(context.Background())
+
+	if config.ListenAddr == "" && len(forwards) == 0 && len(reverses) == 0 && config.DnsListenAddr == "" {
+		log.Err().Error(0, errors.New("LISTEN_ADDR, FORWARDS, REVERSES or DNS_LISTEN_ADDR is required"))
+		return
+	}
+
+	var servers []*tcp.TcpServer
+	listen := func(address string, handle HandleFunc, transparent bool) error {
+		server := tcp.NewServer(true, 8192, 0, func(err error) bool {
+			if _, ok := err.(*net.OpError); ok {
+				// accept deadline reached
+				cancel()
+				return true
+			}
+
+			log.Err().Error(1, err)
+			return false
+		})
+
+		server.Hooks = clientMetrics.ServerHooks()
+		if transparent {
+			server.ListenConfig.Control = tcp.TransparentControl
+		}
+		server.OnConnect(func(ctx context.Context, tc *tcp.TcpConn) {
+			defer tc.Close()
+			connLog := log.With().Value("client_ip", tc.TCPConn.RemoteAddr().String()).Logger()
+
+			if err := handle(tc, connLog); err != nil {
+				clientMetrics.reject(err)
+				connLog.Err().Error(0, err)
+				return
+			}
+		})
+
+		servers = append(servers, server)
+		return server.Start(context.Background(), "tcp", address)
+	}
+
+	if config.ListenAddr != "" {
+		if err = listen(config.ListenAddr, handle, config.Mode == "transparent" && config.Tproxy); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+	}
+
+	for _, forward := range forwards {
+		if err = listen(forward.Listen, handler.HandleForward(forward.Target), false); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+	}
+
+	if config.DnsListenAddr != "" {
+		forwarder := &DnsForwarder{
+			Upstreams:     upstreams,
+			Resolver:      config.DnsUpstream,
+			Timeout:       config.DnsTimeout,
+			HeaderTimeout: config.HeaderTimeout,
+			Metrics:       clientMetrics,
+		}
+
+		if config.DnsCacheSize > 0 {
+			forwarder.Cache = dns.NewCache(config.DnsCacheSize)
+		}
+
+		if err = listen(config.DnsListenAddr, forwarder.HandleTcp, false); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+
+		udpAddr, err := net.ResolveUDPAddr("udp", config.DnsListenAddr)
+		if err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+
+		udp, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+
+		go forwarder.ServeUdp(sig, udp, log)
+	}
+
+	var reverseWg sync.WaitGroup
+	for _, reverse := range reverses {
+		reverseWg.Add(1)
+		go func(reverse Reverse) {
+			defer reverseWg.Done()
+			handler.ServeReverse(sig, reverse, log)
+		}(reverse)
+	}
 
 	<-sig.Done()
+
+	numConns := 0
+	for _, server := range servers {
+		numConns += server.NumConns()
+	}
+
+	log.Info().Value("connections", numConns).Msg("Draining connections")
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer drainCancel()
+
+	var wg sync.WaitGroup
+	var reset atomic.Int64
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *tcp.TcpServer) {
+			defer wg.Done()
+			n := server.Shutdown(drainCtx, 5*time.Second, func(live int) {
+				log.Info().Value("connections", live).Msg("Draining connections")
+			})
+			reset.Add(int64(n))
+		}(server)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reversesDone := make(chan struct{})
+		go func() {
+			reverseWg.Wait()
+			close(reversesDone)
+		}()
+
+		select {
+		case <-reversesDone:
+		case <-drainCtx.Done():
+			// connections in flight die with the process
+		}
+	}()
+	wg.Wait()
+
+	if n := reset.Load(); n > 0 {
+		log.Warn().Value("connections", n).Msg("Drain timeout reached, connections reset")
+	}
+
 	log.Info().Msg("Exiting application")
 }
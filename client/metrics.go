@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/metrics"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+type Metrics struct {
+	Registry            *metrics.Registry
+	ActiveConnections   *metrics.Gauge
+	AcceptedConnections *metrics.Counter
+	RejectedConnections *metrics.CounterVec
+	HandshakeFailures   *metrics.CounterVec
+	DialDuration        *metrics.Histogram
+	DialFailures        *metrics.Counter
+	Bytes               *metrics.CounterVec
+	DnsQueries          *metrics.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+
+	return &Metrics{
+		Registry:            r,
+		ActiveConnections:   r.Gauge("buggy_client_active_connections", "Number of open local connections."),
+		AcceptedConnections: r.Counter("buggy_client_accepted_connections_total", "Number of accepted local connections."),
+		RejectedConnections: r.CounterVec("buggy_client_rejected_connections_total", "Number of local connections refused by the client or buggy-server, by reason.", "reason"),
+		HandshakeFailures:   r.CounterVec("buggy_client_tls_handshake_failures_total", "Number of failed TLS handshakes with buggy-server, by error class.", "class"),
+		DialDuration:        r.Histogram("buggy_client_dial_duration_seconds", "Time taken by successful dials to buggy-server.", metrics.DefaultLatencyBuckets),
+		DialFailures:        r.Counter("buggy_client_dial_failures_total", "Number of failed dials to buggy-server."),
+		Bytes:               r.CounterVec("buggy_client_bytes_total", "Bytes relayed between local apps and the tunnel, by direction.", "direction"),
+		DnsQueries:          r.CounterVec("buggy_client_dns_queries_total", "Number of DNS queries of local apps, by result: hit, miss, error or malformed.", "result"),
+	}
+}
+
+func (self *Metrics) ServerHooks() tcp.ServerHooks {
+	return tcp.ServerHooks{
+		Accepted: func(*tcp.TcpConn) {
+			self.AcceptedConnections.Inc()
+			self.ActiveConnections.Inc()
+		},
+		Closed: func(*tcp.TcpConn) {
+			self.ActiveConnections.Dec()
+		},
+	}
+}
+
+func (self *Metrics) DialerHooks() tcp.DialerHooks {
+	return tcp.DialerHooks{
+		Dialed: func(address string, elapsed time.Duration, err error) {
+			if err != nil {
+				self.DialFailures.Inc()
+				return
+			}
+			self.DialDuration.Observe(elapsed.Seconds())
+		},
+	}
+}
+
+// addStats counts traffic of a local connection, where dst of stats is the local app
+func (self *Metrics) addStats(stats *tcp.SpliceStats) {
+	self.Bytes.With("up").Add(uint64(stats.DstToSrc))
+	self.Bytes.With("down").Add(uint64(stats.SrcToDst))
+}
+
+// reject counts err if it refused a local connection
+func (self *Metrics) reject(err error) {
+	var connectErr *ConnectError
+
+	switch {
+	case errors.As(err, &connectErr):
+		reason := connectErr.ProxyError()
+		if reason == "" {
+			reason = "http_" + strconv.Itoa(connectErr.Response.StatusCode)
+		}
+		self.RejectedConnections.With(reason).Inc()
+	case err == ErrRouteRejected:
+		self.RejectedConnections.With("route_rejected").Inc()
+	case err == ErrSocksAuthFailed, err == ErrSocksNoAcceptableMethod:
+		self.RejectedConnections.With("socks_auth_failed").Inc()
+	case err == ErrSocksVersion, err == ErrSocksCommandNotSupported, err == ErrSocksAddressNotSupported:
+		self.RejectedConnections.With("socks_request_error").Inc()
+	case err == ErrProxyAuthRequired:
+		self.RejectedConnections.With("proxy_auth_failed").Inc()
+	case err == ErrHttpNotAbsoluteUrl:
+		self.RejectedConnections.With("http_request_error").Inc()
+	}
+}
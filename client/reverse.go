@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/log"
+)
+
+// Reverse exposes a local service through buggy-server, which binds Remote, a port or a host name
+type Reverse struct {
+	Remote string
+	Local  string
+}
+
+// ParseReverses parses a comma separated list of remote_port_or_host->local_host:port, e.g.
+//
+//	8022->127.0.0.1:22,dev.example.org->127.0.0.1:8080
+func ParseReverses(s string) (ret []Reverse, err error) {
+	for _, mapping := range strings.Split(s, ",") {
+		if mapping = strings.TrimSpace(mapping); mapping == "" {
+			continue
+		}
+
+		remote, local, ok := strings.Cut(mapping, "->")
+		if !ok || strings.TrimSpace(remote) == "" {
+			return nil, fmt.Errorf("Malformed reverse tunnel %s, expecting port_or_host->host:port", mapping)
+		}
+
+		reverse := Reverse{Remote: strings.TrimSpace(remote), Local: strings.TrimSpace(local)}
+		if _, _, err = net.SplitHostPort(reverse.Local); err != nil {
+			return nil, fmt.Errorf("Malformed reverse tunnel %s: %w", mapping, err)
+		}
+
+		ret = append(ret, reverse)
+	}
+	return
+}
+
+// ServeReverse keeps reverse.Remote bound on a buggy-server until ctx is done, and splices connections
+// pushed down by the server with new connections to reverse.Local. Lost binds are retried with exponential backoff.
+func (self *Handler) ServeReverse(ctx context.Context, reverse Reverse, logger log.Logger) {
+	logger = logger.With().Value("bind", reverse.Remote).Value("local", reverse.Local).Logger()
+
+	for backoff := minBackoff; ; {
+		start := time.Now()
+		err := self.serveBind(ctx, reverse, logger)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a bind that lasted is not a failure streak
+		if time.Since(start) > self.Upstreams.maxBackoff {
+			backoff = minBackoff
+		}
+
+		logger.Warn().Value("error", err.Error()).Value("retry_in", backoff.String()).Msg("Reverse tunnel down")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, self.Upstreams.maxBackoff)
+	}
+}
+
+// serveBind binds reverse.Remote, and serves its connections until the bind is lost or ctx is done
+func (self *Handler) serveBind(ctx context.Context, reverse Reverse, logger log.Logger) error {
+	session, ctrl, err := self.Upstreams.Bind(reverse.Remote)
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+	logger.Info().Msg("Reverse tunnel bound")
+
+	// on drain, release the bind and take no new connections, but let those in flight finish
+	stop := context.AfterFunc(ctx, func() {
+		session.GoAway()
+		ctrl.Close()
+	})
+	defer stop()
+
+	go func() {
+		// nothing is sent on ctrl after BIND, so it ends when the server releases the bind
+		io.Copy(io.Discard, ctrl)
+		if ctx.Err() == nil {
+			session.Close()
+		}
+	}()
+
+	var streams sync.WaitGroup
+	defer streams.Wait()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			defer stream.Close()
+
+			local, err := self.Dialer.Dial(reverse.Local)
+			if err != nil {
+				stream.Reset()
+				logger.Err().Error(0, err)
+				return
+			}
+
+			defer local.Close()
+
+			// local is the service here, and the tunnel carries the remote peer
+			if err = self.splice(local, stream, "", logger); err != nil {
+				logger.Err().Error(0, err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/z-george-ma/buggy/v2/lib"
+)
+
+var ErrRouteRejected = errors.New("Destination rejected by routing rules")
+
+// Route is the path a connection takes to its destination
+type Route int
+
+const (
+	RouteTunnel Route = iota
+	RouteDirect
+	RouteReject
+)
+
+func (self Route) String() string {
+	switch self {
+	case RouteDirect:
+		return "direct"
+	case RouteReject:
+		return "reject"
+	}
+	return "tunnel"
+}
+
+type routeRule struct {
+	route Route
+	// any matches all destinations
+	any bool
+	// domain matches the domain and its subdomains
+	domain string
+	cidrs  []*net.IPNet
+	ports  []lib.PortRange
+}
+
+// Router picks the route of destinations by an ordered list of rules.
+// First matching rule wins, and destinations matching no rule go through the tunnel.
+//
+// Each line of a routes file is a rule:
+//
+//	<tunnel|direct|reject> <domain suffix|CIDR|geoip:file|*> [port,from-to,...]
+//
+// Example:
+//
+//	direct corp.example.com
+//	direct 192.168.0.0/16
+//	reject * 25
+//	direct geoip:/etc/buggy/cn.txt 80,443
+//
+// A geoip file lists one CIDR per line. CIDR and geoip rules only match destinations
+// given as IP addresses, as resolving names locally would leak them.
+type Router struct {
+	rules []routeRule
+}
+
+func loadCidrs(file string) (ret []*net.IPNet, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+
+		_, cidr, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, lineNo, err)
+		}
+		ret = append(ret, cidr)
+	}
+
+	return ret, scanner.Err()
+}
+
+func LoadRouter(file string) (ret *Router, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	ret = &Router{}
+	geoip := map[string][]*net.IPNet{}
+	scanner := bufio.NewScanner(f)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: malformed rule", file, lineNo)
+		}
+
+		var rule routeRule
+		switch fields[0] {
+		case "tunnel":
+			rule.route = RouteTunnel
+		case "direct":
+			rule.route = RouteDirect
+		case "reject":
+			rule.route = RouteReject
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown route %s", file, lineNo, fields[0])
+		}
+
+		if fields[1] == "*" {
+			rule.any = true
+		} else if geoipFile, ok := strings.CutPrefix(fields[1], "geoip:"); ok {
+			cidrs, ok := geoip[geoipFile]
+			if !ok {
+				if cidrs, err = loadCidrs(geoipFile); err != nil {
+					return nil, err
+				}
+				geoip[geoipFile] = cidrs
+			}
+			rule.cidrs = cidrs
+		} else if _, cidr, e := net.ParseCIDR(fields[1]); e == nil {
+			rule.cidrs = []*net.IPNet{cidr}
+		} else {
+			rule.domain = strings.ToLower(strings.Trim(fields[1], "."))
+		}
+
+		if len(fields) == 3 {
+			if rule.ports, err = lib.ParsePorts(fields[2]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, lineNo, err)
+			}
+		}
+
+		ret.rules = append(ret.rules, rule)
+	}
+
+	return ret, scanner.Err()
+}
+
+func (self *routeRule) match(host string, ip net.IP, port int) bool {
+	if len(self.ports) > 0 {
+		matched := false
+		for _, r := range self.ports {
+			if r.Contains(port) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	switch {
+	case self.any:
+		return true
+	case self.domain != "":
+		return ip == nil && (host == self.domain || strings.HasSuffix(host, "."+self.domain))
+	case ip != nil:
+		for _, cidr := range self.cidrs {
+			if cidr.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Route returns the route of host:port target. A nil router routes everything through the tunnel.
+func (self *Router) Route(target string) (Route, error) {
+	if self == nil {
+		return RouteTunnel, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return RouteReject, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return RouteReject, err
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+
+	for i := range self.rules {
+		if self.rules[i].match(host, ip, port) {
+			return self.rules[i].route, nil
+		}
+	}
+
+	return RouteTunnel, nil
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+const (
+	socksVersion              byte = 5
+	socksAuthVersion          byte = 1
+	socksMethodNoAuth         byte = 0
+	socksMethodPassword       byte = 2
+	socksMethodNoAccept       byte = 0xff
+	socksCmdConnect           byte = 1
+	socksCmdUdpAssociate      byte = 3
+	socksAtypIPv4             byte = 1
+	socksAtypDomain           byte = 3
+	socksAtypIPv6             byte = 4
+	socksReplySucceeded       byte = 0
+	socksReplyFailure         byte = 1
+	socksReplyNotAllowed      byte = 2
+	socksReplyNetUnreach      byte = 3
+	socksReplyHostUnreach     byte = 4
+	socksReplyConnRefused     byte = 5
+	socksReplyTTLExpired      byte = 6
+	socksReplyCmdUnsupported  byte = 7
+	socksReplyAtypUnsupported byte = 8
+)
+
+var ErrSocksVersion = errors.New("Unsupported SOCKS version")
+var ErrSocksNoAcceptableMethod = errors.New("No acceptable SOCKS authentication method")
+var ErrSocksAuthFailed = errors.New("SOCKS authentication failed")
+var ErrSocksCommandNotSupported = errors.New("SOCKS command not supported")
+var ErrSocksAddressNotSupported = errors.New("SOCKS address type not supported")
+
+// Credentials authenticate local apps
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Match compares username and password in constant time
+func (self *Credentials) Match(username []byte, password []byte) bool {
+	return subtle.ConstantTimeCompare(username, []byte(self.Username)) == 1 &&
+		subtle.ConstantTimeCompare(password, []byte(self.Password)) == 1
+}
+
+func socksReply(conn tcp.Conn, code byte) error {
+	// bound address is not known to the client, reply with 0.0.0.0:0
+	return socksReplyBound(conn, code, net.IPv4zero, 0)
+}
+
+// socksReplyBound replies with BND.ADDR and BND.PORT
+func socksReplyBound(conn tcp.Conn, code byte, ip net.IP, port int) error {
+	reply := []byte{socksVersion, code, 0}
+	reply = appendSocksAddress(reply, ip.String(), port)
+
+	if _, err := conn.Write(reply); err != nil {
+		return err
+	}
+
+	return conn.Flush()
+}
+
+// appendSocksAddress appends ATYP, ADDR and PORT of host and port to b
+func appendSocksAddress(b []byte, host string, port int) []byte {
+	if ip := net.ParseIP(host); ip == nil {
+		b = append(b, socksAtypDomain, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, socksAtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socksAtypIPv6)
+		b = append(b, ip.To16()...)
+	}
+
+	return append(b, byte(port>>8), byte(port))
+}
+
+// socksReplyCode maps a tunnel failure to SOCKS5 reply code
+func socksReplyCode(err error) byte {
+	var connectErr *ConnectError
+	if errors.As(err, &connectErr) {
+		switch connectErr.ProxyError() {
+		case "destination_ip_prohibited", "http_request_denied":
+			return socksReplyNotAllowed
+		case "destination_ip_unroutable":
+			return socksReplyNetUnreach
+		case "dns_error", "dns_timeout", "destination_not_found", "destination_unavailable":
+			return socksReplyHostUnreach
+		case "connection_refused":
+			return socksReplyConnRefused
+		case "connection_timeout":
+			return socksReplyTTLExpired
+		}
+
+		switch connectErr.Response.StatusCode {
+		case 403:
+			return socksReplyNotAllowed
+		case 502:
+			return socksReplyConnRefused
+		case 504:
+			return socksReplyHostUnreach
+		}
+		return socksReplyFailure
+	}
+
+	var netErr net.Error
+	var dnsErr *net.DNSError
+
+	switch {
+	case err == ErrRouteRejected:
+		return socksReplyNotAllowed
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socksReplyTTLExpired
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		// direct dial failures
+		return socksReplyHostUnreach
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksReplyNetUnreach
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksReplyConnRefused
+	}
+
+	return socksReplyFailure
+}
+
+func socksAuthenticate(conn tcp.Conn, auth *Credentials) (err error) {
+	buf := make([]byte, 255)
+
+	if _, err = conn.ReadFull(buf[:2]); err != nil {
+		return
+	}
+
+	if buf[0] != socksVersion {
+		return ErrSocksVersion
+	}
+
+	methods := buf[:buf[1]]
+	if _, err = conn.ReadFull(methods); err != nil {
+		return
+	}
+
+	want := socksMethodNoAuth
+	if auth != nil {
+		want = socksMethodPassword
+	}
+
+	selected := socksMethodNoAccept
+	for _, m := range methods {
+		if m == want {
+			selected = want
+			break
+		}
+	}
+
+	if _, err = conn.Write([]byte{socksVersion, selected}); err != nil {
+		return
+	}
+
+	if err = conn.Flush(); err != nil {
+		return
+	}
+
+	if selected == socksMethodNoAccept {
+		return ErrSocksNoAcceptableMethod
+	}
+
+	if selected == socksMethodNoAuth {
+		return
+	}
+
+	// RFC 1929 username/password sub-negotiation
+	if _, err = conn.ReadFull(buf[:2]); err != nil {
+		return
+	}
+
+	if buf[0] != socksAuthVersion {
+		return ErrSocksVersion
+	}
+
+	username := make([]byte, buf[1])
+	if _, err = conn.ReadFull(username); err != nil {
+		return
+	}
+
+	if _, err = conn.ReadFull(buf[:1]); err != nil {
+		return
+	}
+
+	password := make([]byte, buf[0])
+	if _, err = conn.ReadFull(password); err != nil {
+		return
+	}
+
+	status := byte(0)
+	if !auth.Match(username, password) {
+		status = 1
+		err = ErrSocksAuthFailed
+	}
+
+	if _, e := conn.Write([]byte{socksAuthVersion, status}); e != nil {
+		return e
+	}
+
+	if e := conn.Flush(); e != nil {
+		return e
+	}
+
+	return
+}
+
+// readSocksAddress reads ATYP, DST.ADDR and DST.PORT and returns host:port
+func readSocksAddress(conn tcp.Reader) (address string, err error) {
+	buf := make([]byte, 256)
+
+	if _, err = conn.ReadFull(buf[:1]); err != nil {
+		return
+	}
+
+	var host string
+	switch buf[0] {
+	case socksAtypIPv4:
+		if _, err = conn.ReadFull(buf[:net.IPv4len]); err != nil {
+			return
+		}
+		host = net.IP(buf[:net.IPv4len]).String()
+	case socksAtypIPv6:
+		if _, err = conn.ReadFull(buf[:net.IPv6len]); err != nil {
+			return
+		}
+		host = net.IP(buf[:net.IPv6len]).String()
+	case socksAtypDomain:
+		if _, err = conn.ReadFull(buf[:1]); err != nil {
+			return
+		}
+		l := buf[0]
+		if _, err = conn.ReadFull(buf[:l]); err != nil {
+			return
+		}
+		host = string(buf[:l])
+	default:
+		return "", ErrSocksAddressNotSupported
+	}
+
+	if _, err = conn.ReadFull(buf[:2]); err != nil {
+		return
+	}
+
+	port := int(buf[0])<<8 | int(buf[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// readSocksRequest authenticates the client and returns the command and target of the request
+func readSocksRequest(conn tcp.Conn, auth *Credentials) (command byte, target string, err error) {
+	if err = socksAuthenticate(conn, auth); err != nil {
+		return
+	}
+
+	buf := make([]byte, 3)
+	if _, err = conn.ReadFull(buf); err != nil {
+		return
+	}
+
+	if buf[0] != socksVersion {
+		return 0, "", ErrSocksVersion
+	}
+
+	command = buf[1]
+	if command != socksCmdConnect && command != socksCmdUdpAssociate {
+		socksReply(conn, socksReplyCmdUnsupported)
+		return 0, "", ErrSocksCommandNotSupported
+	}
+
+	target, err = readSocksAddress(conn)
+	if err == ErrSocksAddressNotSupported {
+		socksReply(conn, socksReplyAtypUnsupported)
+	}
+	return
+}
+
+// HandleSocks serves a SOCKS5 CONNECT or UDP ASSOCIATE request from conn over the tunnel
+func (self *Handler) HandleSocks(conn tcp.Conn, logger log.Logger) (err error) {
+	var command byte
+	var target string
+	err = tcp.RunWithTimeout(conn, self.HeaderTimeout, tcp.ErrHeaderTimeout, func() (err error) {
+		command, target, err = readSocksRequest(conn, self.SocksAuth)
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	if command == socksCmdUdpAssociate {
+		return self.handleUdpAssociate(conn, logger)
+	}
+
+	up, route, err := self.connect(target)
+	if err != nil {
+		socksReply(conn, socksReplyCode(err))
+		return
+	}
+
+	defer up.Close()
+
+	if err = socksReply(conn, socksReplySucceeded); err != nil {
+		return
+	}
+
+	return self.splice(conn, up, target, logger.With().Value("route", route.String()).Logger())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+// HandleTransparent serves connections diverted to the listener by iptables, for apps unaware of any proxy.
+// The destination is the original destination recorded by conntrack for REDIRECT, or the local address of
+// the connection for TPROXY. E.g. to divert traffic of a network namespace to buggy-client listening on :12345:
+//
+//	iptables -t nat -A PREROUTING -i veth0 -p tcp -j REDIRECT --to-ports 12345
+//
+// or with TPROXY, with packets marked 1 routed to the loopback interface:
+//
+//	iptables -t mangle -A PREROUTING -i veth0 -p tcp -j TPROXY --on-port 12345 --tproxy-mark 1
+//	ip rule add fwmark 1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//
+// Connections made to listenAddr directly are rejected. scripts/transparent-netns.sh tests both modes.
+func (self *Handler) HandleTransparent(tproxy bool, listenAddr string) HandleFunc {
+	return func(conn tcp.Conn, logger log.Logger) error {
+		tc := conn.(*tcp.TcpConn)
+
+		dst := tc.TCPConn.LocalAddr().(*net.TCPAddr)
+		if !tproxy {
+			var err error
+			if dst, err = tcp.OriginalDst(tc.TCPConn); err != nil {
+				return err
+			}
+		}
+
+		if tcp.IsListenerAddr(dst, listenAddr) {
+			// connected to the listener directly rather than diverted to it, relaying it would loop
+			return tcp.ErrNoOriginalDst
+		}
+		target := dst.String()
+
+		up, route, err := self.connect(target)
+		if err != nil {
+			return err
+		}
+
+		defer up.Close()
+
+		return self.splice(conn, up, target, logger.With().Value("route", route.String()).Logger())
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+var ErrBindNeedsMux = errors.New("Server does not support mux, which reverse tunnels require")
+
+// ConnectError is returned when buggy-server rejects CONNECT, BIND or connect-udp requests
+type ConnectError struct {
+	// Method is CONNECT, BIND of reverse tunnels, or GET of connect-udp
+	Method   string
+	Response tcp.HttpResponse
+	// Body is the response body, if small enough to keep
+	Body []byte
+}
+
+// ProxyError returns the error type of the Proxy-Status header (RFC 9209), or empty string if absent
+func (self *ConnectError) ProxyError() string {
+	for _, param := range strings.Split(self.Response.Headers["proxy-status"], ";") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && k == "error" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+func (self *ConnectError) Error() string {
+	return fmt.Sprintf("%s rejected by server: %d %s", self.Method, self.Response.StatusCode, self.Response.Reason)
+}
+
+// error responses of buggy-server are short, larger bodies are dropped
+const maxErrorBodySize = 4096
+
+type TunnelOptions struct {
+	// Mux carries connections as streams of a single TLS session, when buggy-server negotiates it
+	Mux bool
+	// MuxKeepAlive is the ping interval of the multiplexed session
+	MuxKeepAlive     time.Duration
+	HandshakeTimeout time.Duration
+	// HeaderTimeout limits the time to read CONNECT response
+	HeaderTimeout time.Duration
+	Metrics       *Metrics
+}
+
+// Tunnel opens mTLS connections to buggy-server
+type Tunnel struct {
+	dialer  *tcp.TcpDialer
+	address string
+	// tlsConfig is called per dial, to pick up reloaded certificates
+	tlsConfig func() *tls.Config
+	options   TunnelOptions
+	mu        sync.Mutex
+	session   *tcp.MuxSession
+	// moving average of dial and handshake time in ns, 0 if never dialed
+	latency atomic.Int64
+}
+
+func NewTunnel(dialer *tcp.TcpDialer, address string, tlsConfig func() *tls.Config, options TunnelOptions) *Tunnel {
+	return &Tunnel{
+		dialer:    dialer,
+		address:   address,
+		tlsConfig: tlsConfig,
+		options:   options,
+	}
+}
+
+// Address is the host:port of buggy-server
+func (self *Tunnel) Address() string {
+	return self.address
+}
+
+// Latency returns the moving average of dial and handshake time, or 0 if never dialed
+func (self *Tunnel) Latency() time.Duration {
+	return time.Duration(self.latency.Load())
+}
+
+// dial opens a TLS connection to buggy-server, offering mux if asked
+func (self *Tunnel) dial(mux bool) (*tcp.TlsConn, error) {
+	start := time.Now()
+	down, err := self.dialer.Dial(self.address)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := self.tlsConfig()
+	if mux {
+		tlsConfig.NextProtos = []string{tcp.MuxProtocol, "http/1.1"}
+	}
+
+	conn := tcp.TlsConnect(down, tlsConfig)
+	if err = conn.HandshakeTimeout(self.options.HandshakeTimeout); err != nil {
+		self.options.Metrics.HandshakeFailures.With(tcp.HandshakeErrorClass(err)).Inc()
+		down.Close()
+		return nil, err
+	}
+
+	elapsed := int64(time.Since(start))
+	if old := self.latency.Load(); old > 0 {
+		elapsed = (old*7 + elapsed) / 8
+	}
+	self.latency.Store(elapsed)
+
+	return conn, nil
+}
+
+// Probe dials and handshakes with buggy-server to check it is up
+func (self *Tunnel) Probe() error {
+	conn, err := self.dial(self.options.Mux)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Open returns a connection to buggy-server, which is either a stream of the
+// multiplexed session or a new TLS connection.
+func (self *Tunnel) Open() (tcp.Conn, error) {
+	if !self.options.Mux {
+		return self.dial(false)
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.session != nil {
+		conn, err := self.session.Open()
+		if err == nil {
+			return conn, nil
+		}
+
+		if err != tcp.ErrMuxGoingAway {
+			// a session going away is closed by buggy-server once the streams in flight finish
+			self.session.Close()
+		}
+		self.session = nil
+	}
+
+	conn, err := self.dial(true)
+	if err != nil {
+		return nil, err
+	}
+
+	if conn.Conn.ConnectionState().NegotiatedProtocol != tcp.MuxProtocol {
+		// server does not support mux
+		return conn, nil
+	}
+
+	self.session = tcp.NewMuxSession(conn, true, self.options.MuxKeepAlive, 8192, 8192)
+	return self.session.Open()
+}
+
+// Connect opens a tunnel and asks buggy-server to CONNECT to target.
+func (self *Tunnel) Connect(target string) (conn tcp.Conn, err error) {
+	if conn, err = self.Open(); err != nil {
+		return
+	}
+
+	if err = self.connect(conn, target); err != nil {
+		conn.Close()
+		conn = nil
+	}
+
+	return
+}
+
+// Bind opens a new multiplexed session, and asks buggy-server to bind remote, a port or a host name.
+// Connections to remote are pushed down the session as streams. The bind is released when ctrl is closed.
+func (self *Tunnel) Bind(remote string) (session *tcp.MuxSession, ctrl tcp.Conn, err error) {
+	conn, err := self.dial(true)
+	if err != nil {
+		return
+	}
+
+	if conn.Conn.ConnectionState().NegotiatedProtocol != tcp.MuxProtocol {
+		conn.Close()
+		return nil, nil, ErrBindNeedsMux
+	}
+
+	session = tcp.NewMuxSession(conn, true, self.options.MuxKeepAlive, 8192, 8192)
+	if ctrl, err = session.Open(); err == nil {
+		err = self.request(ctrl, &tcp.HttpRequest{
+			Method:  "BIND",
+			Url:     remote,
+			Version: "HTTP/1.1",
+			Headers: map[string]string{"host": remote},
+		})
+	}
+
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	return
+}
+
+// connect asks buggy-server to CONNECT to target over conn
+func (self *Tunnel) connect(conn tcp.Conn, target string) error {
+	return self.request(conn, &tcp.HttpRequest{
+		Method:  "CONNECT",
+		Url:     target,
+		Version: "HTTP/1.1",
+		Headers: map[string]string{"host": target},
+	})
+}
+
+// connectUdp asks buggy-server to relay UDP datagrams with target over conn, by connect-udp (RFC 9298).
+// Datagrams are then carried as capsules, see tcp.WriteDatagram.
+func (self *Tunnel) connectUdp(conn tcp.Conn, target string) error {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+
+	// IPv6 colons must be percent-encoded too
+	host = strings.ReplaceAll(url.PathEscape(host), ":", "%3A")
+
+	return self.request(conn, &tcp.HttpRequest{
+		Method:  "GET",
+		Url:     "/.well-known/masque/udp/" + host + "/" + port + "/",
+		Version: "HTTP/1.1",
+		Headers: map[string]string{
+			"host":             self.address,
+			"connection":       "Upgrade",
+			"upgrade":          "connect-udp",
+			"capsule-protocol": "?1",
+		},
+	})
+}
+
+// request sends request over conn, and reads the response, which must be 2xx, or 101 if asking to upgrade
+func (self *Tunnel) request(conn tcp.Conn, request *tcp.HttpRequest) (err error) {
+	if err = tcp.WriteHttpRequest(conn, request); err != nil {
+		return
+	}
+
+	if err = conn.Flush(); err != nil {
+		return
+	}
+
+	var response tcp.HttpResponse
+	err = tcp.RunWithTimeout(conn, self.options.HeaderTimeout, tcp.ErrHeaderTimeout, func() (err error) {
+		response, err = tcp.ParseHttpResponse(conn)
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	upgraded := response.StatusCode == 101 && request.Headers["upgrade"] != ""
+	if !upgraded && (response.StatusCode < 200 || response.StatusCode > 299) {
+		connectErr := &ConnectError{Method: request.Method, Response: response}
+		if length, chunked, e := tcp.HttpBodyLength(response.Headers); e == nil && !chunked && length > 0 && length <= maxErrorBodySize {
+			connectErr.Body = make([]byte, length)
+			if _, e = conn.ReadFull(connectErr.Body); e != nil {
+				connectErr.Body = nil
+			}
+		}
+		err = connectErr
+	}
+
+	return
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+var ErrUdpNotTcp = errors.New("UDP ASSOCIATE requires a TCP connection")
+
+// udpFlow relays datagrams of a local app to one target, over a connect-udp tunnel connection or
+// a UDP socket for the direct route. A flow failed to open drops datagrams until it expires.
+type udpFlow struct {
+	target string
+	route  Route
+	// up carries datagrams as capsules, for the tunnel route
+	up tcp.Conn
+	// direct is connected to the target, for the direct route
+	direct *net.UDPConn
+	err    error
+
+	start      time.Time
+	lastActive atomic.Int64
+	stats      tcp.SpliceStats
+	bytesUp    atomic.Int64
+	closed     atomic.Bool
+	// wmu serializes writes to up, by send outside the lock of the association, and by close
+	wmu sync.Mutex
+}
+
+func (self *udpFlow) touch() {
+	self.lastActive.Store(time.Now().UnixNano())
+}
+
+func (self *udpFlow) idle(timeout time.Duration) bool {
+	return time.Since(time.Unix(0, self.lastActive.Load())) >= timeout
+}
+
+// opened tells if the flow is ready to send, guarded by the lock of the association
+func (self *udpFlow) opened() bool {
+	return self.up != nil || self.direct != nil
+}
+
+func (self *udpFlow) send(payload []byte) (err error) {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+
+	if self.closed.Load() {
+		return net.ErrClosed
+	}
+
+	if self.up != nil {
+		if err = tcp.WriteDatagram(self.up, payload); err == nil {
+			err = self.up.Flush()
+		}
+		return
+	}
+
+	_, err = self.direct.Write(payload)
+	return
+}
+
+func (self *udpFlow) receive(buf []byte) ([]byte, error) {
+	if self.up != nil {
+		return tcp.ReadDatagram(self.up, buf)
+	}
+
+	for {
+		n, err := self.direct.Read(buf)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			// ICMP port unreachable of an earlier datagram
+			continue
+		}
+		return buf[:n], err
+	}
+}
+
+// close ends the flow, which unblocks receive. It is called with the lock of the association held.
+func (self *udpFlow) close() {
+	self.wmu.Lock()
+	defer self.wmu.Unlock()
+
+	if !self.closed.CompareAndSwap(false, true) {
+		return
+	}
+
+	if self.up != nil {
+		// buggy-server ends the association on EOF, which in turn ends receive
+		self.up.CloseWrite()
+	}
+
+	if self.direct != nil {
+		self.direct.Close()
+	}
+}
+
+// udpAssociation relays datagrams of a SOCKS5 UDP ASSOCIATE request, keeping a flow per target
+type udpAssociation struct {
+	handler *Handler
+	logger  log.Logger
+	local   *net.UDPConn
+	// peer is the IP of the TCP connection, the only source accepted
+	peer net.IP
+
+	mu    sync.Mutex
+	app   *net.UDPAddr
+	flows map[string]*udpFlow
+	wg    sync.WaitGroup
+}
+
+// parseSocksDatagram returns the target and payload of a SOCKS5 UDP request header (RFC 1928 section 7)
+func parseSocksDatagram(p []byte) (target string, payload []byte, ok bool) {
+	// RSV(2) FRAG(1), fragments are not supported
+	if len(p) < 4 || p[2] != 0 {
+		return
+	}
+
+	var host string
+	switch p[3] {
+	case socksAtypIPv4:
+		if len(p) < 4+net.IPv4len+2 {
+			return
+		}
+		host, p = net.IP(p[4:4+net.IPv4len]).String(), p[4+net.IPv4len:]
+	case socksAtypIPv6:
+		if len(p) < 4+net.IPv6len+2 {
+			return
+		}
+		host, p = net.IP(p[4:4+net.IPv6len]).String(), p[4+net.IPv6len:]
+	case socksAtypDomain:
+		if len(p) < 5 || len(p) < 5+int(p[4])+2 {
+			return
+		}
+		host, p = string(p[5:5+int(p[4])]), p[5+int(p[4]):]
+	default:
+		return
+	}
+
+	port := int(p[0])<<8 | int(p[1])
+	return net.JoinHostPort(host, strconv.Itoa(port)), p[2:], true
+}
+
+// handleUdpAssociate serves a SOCKS5 UDP ASSOCIATE request. Datagrams are relayed while conn stays open.
+func (self *Handler) handleUdpAssociate(conn tcp.Conn, logger log.Logger) (err error) {
+	tc, ok := conn.(*tcp.TcpConn)
+	if !ok {
+		socksReply(conn, socksReplyFailure)
+		return ErrUdpNotTcp
+	}
+
+	localAddr := tc.TCPConn.LocalAddr().(*net.TCPAddr)
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP, Zone: localAddr.Zone})
+	if err != nil {
+		socksReply(conn, socksReplyFailure)
+		return
+	}
+
+	defer local.Close()
+
+	bound := local.LocalAddr().(*net.UDPAddr)
+	if err = socksReplyBound(conn, socksReplySucceeded, bound.IP, bound.Port); err != nil {
+		return
+	}
+
+	assoc := &udpAssociation{
+		handler: self,
+		logger:  logger.With().Value("protocol", "udp").Logger(),
+		local:   local,
+		peer:    tc.TCPConn.RemoteAddr().(*net.TCPAddr).IP,
+		flows:   map[string]*udpFlow{},
+	}
+
+	done := make(chan struct{})
+	go assoc.expire(done)
+	go assoc.serve()
+
+	// the association ends when the local app closes the TCP connection
+	io.Copy(io.Discard, conn)
+
+	close(done)
+	local.Close()
+	assoc.closeAll()
+	assoc.wg.Wait()
+	return nil
+}
+
+// serve reads datagrams of the local app and sends them to the flow of their target
+func (self *udpAssociation) serve() {
+	buf := make([]byte, tcp.MaxDatagramSize)
+	for {
+		n, from, err := self.local.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if !from.IP.Equal(self.peer) {
+			continue
+		}
+
+		target, payload, ok := parseSocksDatagram(buf[:n])
+		if !ok {
+			continue
+		}
+
+		self.mu.Lock()
+		self.app = from
+		flow := self.flows[target]
+		if flow == nil {
+			flow = &udpFlow{target: target, start: time.Now()}
+			flow.touch()
+			self.flows[target] = flow
+			self.wg.Add(1)
+			// opening a tunnel flow may take a round trip, so it should not hold up other flows
+			go self.open(flow, append([]byte{}, payload...))
+			self.mu.Unlock()
+			continue
+		}
+		opened := flow.opened()
+		self.mu.Unlock()
+
+		if !opened {
+			// failed, or still opening
+			continue
+		}
+
+		flow.touch()
+		flow.bytesUp.Add(int64(len(payload)))
+		flow.send(payload)
+	}
+}
+
+// open opens flow by the route of its target and sends the first payload, then relays replies until it is closed
+func (self *udpAssociation) open(flow *udpFlow, payload []byte) {
+	defer self.wg.Done()
+
+	logger := self.logger.With().Value("target", flow.target).Logger()
+	up, direct, err := self.dial(flow)
+
+	self.mu.Lock()
+	flow.up, flow.direct, flow.err = up, direct, err
+	closed := flow.closed.Load()
+	if err == nil && !closed {
+		// under the lock, so that it goes ahead of datagrams sent by serve
+		flow.touch()
+		flow.bytesUp.Add(int64(len(payload)))
+		flow.send(payload)
+	}
+	self.mu.Unlock()
+
+	if closed {
+		// association ended while opening
+		if up != nil {
+			up.Reset()
+		}
+		if direct != nil {
+			direct.Close()
+		}
+		return
+	}
+
+	if err != nil {
+		self.handler.Metrics.reject(err)
+		logger.Err().Error(0, err)
+		// flow drops datagrams to target until it expires
+		return
+	}
+
+	self.relay(flow, logger.With().Value("route", flow.route.String()).Logger())
+}
+
+func (self *udpAssociation) dial(flow *udpFlow) (up tcp.Conn, direct *net.UDPConn, err error) {
+	if flow.route, err = self.handler.Router.Route(flow.target); err != nil {
+		return
+	}
+
+	switch flow.route {
+	case RouteReject:
+		err = ErrRouteRejected
+	case RouteDirect:
+		var c net.Conn
+		if c, err = net.DialTimeout("udp", flow.target, self.handler.Dialer.Dialer.Timeout); err == nil {
+			direct = c.(*net.UDPConn)
+		}
+	default:
+		up, err = self.handler.Upstreams.ConnectUdp(flow.target)
+	}
+	return
+}
+
+// relay writes datagrams from the target to the local app, with the SOCKS5 UDP header
+func (self *udpAssociation) relay(flow *udpFlow, logger log.Logger) {
+	host, portStr, _ := net.SplitHostPort(flow.target)
+	port, _ := strconv.Atoi(portStr)
+	header := appendSocksAddress([]byte{0, 0, 0}, host, port)
+
+	buf := make([]byte, len(header)+tcp.MaxDatagramSize)
+	copy(buf, header)
+
+	var err error
+	for {
+		var payload []byte
+		if payload, err = flow.receive(buf[len(header):]); err != nil {
+			break
+		}
+
+		flow.touch()
+		flow.stats.SrcToDst += int64(len(payload))
+
+		self.mu.Lock()
+		app := self.app
+		self.mu.Unlock()
+
+		self.local.WriteToUDP(buf[:len(header)+len(payload)], app)
+	}
+
+	self.mu.Lock()
+	if !flow.closed.Load() {
+		// ended by the tunnel or the target rather than by expiry
+		flow.stats.SrcClosedFirst = true
+		if err != io.EOF {
+			flow.stats.SrcToDstErr = err
+		}
+		flow.close()
+	}
+
+	if self.flows[flow.target] == flow {
+		delete(self.flows, flow.target)
+	}
+	self.mu.Unlock()
+
+	if flow.up != nil {
+		flow.wmu.Lock()
+		flow.up.Close()
+		flow.wmu.Unlock()
+	}
+
+	flow.stats.DstToSrc = flow.bytesUp.Load()
+	flow.stats.Duration = time.Since(flow.start)
+	self.handler.logStats(&flow.stats, flow.target, logger)
+}
+
+// expire closes flows idle for UdpIdleTimeout, and forgets failed flows so that they may be retried
+func (self *udpAssociation) expire(done chan struct{}) {
+	timeout := self.handler.UdpIdleTimeout
+	if timeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		self.mu.Lock()
+		for target, flow := range self.flows {
+			if !flow.idle(timeout) {
+				continue
+			}
+
+			if flow.err != nil {
+				delete(self.flows, target)
+			} else if flow.opened() {
+				flow.close()
+			}
+		}
+		self.mu.Unlock()
+	}
+}
+
+// closeAll closes all flows, when the association ends
+func (self *udpAssociation) closeAll() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for target, flow := range self.flows {
+		flow.close()
+		delete(self.flows, target)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+// Strategies of picking a buggy-server
+const (
+	StrategyFailover         = "failover"
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastConnections = "least-connections"
+	StrategyLowestLatency    = "lowest-latency"
+)
+
+const minBackoff = time.Second
+
+type upstream struct {
+	tunnel *Tunnel
+	// live connections
+	active   atomic.Int64
+	mu       sync.Mutex
+	ejected  bool
+	checking bool
+}
+
+// countedConn decrements the live connections of upstream when closed
+type countedConn struct {
+	tcp.Conn
+	once     sync.Once
+	upstream *upstream
+}
+
+func (self *countedConn) release() {
+	self.once.Do(func() {
+		self.upstream.active.Add(-1)
+	})
+}
+
+func (self *countedConn) Reset() error {
+	self.release()
+	return self.Conn.Reset()
+}
+
+func (self *countedConn) Close() error {
+	self.release()
+	return self.Conn.Close()
+}
+
+// Upstreams spreads connections over buggy-servers by strategy. Servers failing to connect
+// are ejected, and health-checked in the background with exponential backoff until they recover.
+type Upstreams struct {
+	strategy   string
+	upstreams  []*upstream
+	next       atomic.Uint64
+	maxBackoff time.Duration
+	logger     log.Logger
+}
+
+func NewUpstreams(tunnels []*Tunnel, strategy string, maxBackoff time.Duration, logger log.Logger) (*Upstreams, error) {
+	switch strategy {
+	case StrategyFailover, StrategyRoundRobin, StrategyLeastConnections, StrategyLowestLatency:
+	default:
+		return nil, fmt.Errorf("Unknown upstream strategy %s", strategy)
+	}
+
+	if len(tunnels) == 0 {
+		return nil, errors.New("No upstream server")
+	}
+
+	if maxBackoff < minBackoff {
+		maxBackoff = minBackoff
+	}
+
+	ret := &Upstreams{
+		strategy:   strategy,
+		maxBackoff: maxBackoff,
+		logger:     logger,
+	}
+
+	for _, tunnel := range tunnels {
+		ret.upstreams = append(ret.upstreams, &upstream{tunnel: tunnel})
+	}
+
+	return ret, nil
+}
+
+// candidates returns upstreams in the order to try: healthy ones by strategy, then ejected ones as last resort
+func (self *Upstreams) candidates() []*upstream {
+	ordered := make([]*upstream, len(self.upstreams))
+	copy(ordered, self.upstreams)
+
+	switch self.strategy {
+	case StrategyRoundRobin:
+		n := int((self.next.Add(1) - 1) % uint64(len(ordered)))
+		ordered = append(ordered[n:], ordered[:n]...)
+	case StrategyLeastConnections:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].active.Load() < ordered[j].active.Load()
+		})
+	case StrategyLowestLatency:
+		// servers never dialed go first, to be measured
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].tunnel.Latency() < ordered[j].tunnel.Latency()
+		})
+	}
+
+	healthy := ordered[:0:0]
+	var ejected []*upstream
+	for _, u := range ordered {
+		u.mu.Lock()
+		if u.ejected {
+			ejected = append(ejected, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+		u.mu.Unlock()
+	}
+
+	return append(healthy, ejected...)
+}
+
+func (self *Upstreams) eject(u *upstream, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.ejected {
+		self.logger.Warn().Value("upstream", u.tunnel.Address()).Value("error", err.Error()).Msg("Upstream ejected")
+	}
+
+	u.ejected = true
+	if !u.checking {
+		u.checking = true
+		go self.healthCheck(u)
+	}
+}
+
+func (self *Upstreams) recover(u *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.ejected {
+		self.logger.Info().Value("upstream", u.tunnel.Address()).Msg("Upstream recovered")
+	}
+	u.ejected = false
+}
+
+func (self *Upstreams) healthCheck(u *upstream) {
+	for backoff := minBackoff; ; backoff = min(backoff*2, self.maxBackoff) {
+		time.Sleep(backoff)
+
+		u.mu.Lock()
+		if !u.ejected {
+			// recovered by a connection
+			u.checking = false
+			u.mu.Unlock()
+			return
+		}
+		u.mu.Unlock()
+
+		if u.tunnel.Probe() == nil {
+			self.recover(u)
+			u.mu.Lock()
+			u.checking = false
+			u.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (self *Upstreams) track(u *upstream, conn tcp.Conn) tcp.Conn {
+	self.recover(u)
+	u.active.Add(1)
+	return &countedConn{Conn: conn, upstream: u}
+}
+
+// Open returns a connection to a buggy-server, trying the next server if one fails
+func (self *Upstreams) Open() (conn tcp.Conn, err error) {
+	for _, u := range self.candidates() {
+		if conn, err = u.tunnel.Open(); err == nil {
+			return self.track(u, conn), nil
+		}
+		self.eject(u, err)
+	}
+
+	return
+}
+
+// Connect asks a buggy-server to CONNECT to target. It tries the next server if one fails before
+// answering, but not if the server rejects the target.
+func (self *Upstreams) Connect(target string) (tcp.Conn, error) {
+	return self.request(target, (*Tunnel).connect)
+}
+
+// ConnectUdp asks a buggy-server to relay UDP datagrams with target, with failover like Connect
+func (self *Upstreams) ConnectUdp(target string) (tcp.Conn, error) {
+	return self.request(target, (*Tunnel).connectUdp)
+}
+
+func (self *Upstreams) request(target string, request func(*Tunnel, tcp.Conn, string) error) (conn tcp.Conn, err error) {
+	for _, u := range self.candidates() {
+		if conn, err = u.tunnel.Open(); err != nil {
+			self.eject(u, err)
+			continue
+		}
+
+		if err = request(u.tunnel, conn, target); err == nil {
+			return self.track(u, conn), nil
+		}
+
+		conn.Close()
+		conn = nil
+
+		var connectErr *ConnectError
+		if errors.As(err, &connectErr) {
+			return
+		}
+
+		self.eject(u, err)
+	}
+
+	return
+}
+
+// Bind asks a buggy-server to bind remote for a reverse tunnel. It tries the next server if one fails
+// before answering, but not if the server rejects the bind.
+func (self *Upstreams) Bind(remote string) (session *tcp.MuxSession, ctrl tcp.Conn, err error) {
+	for _, u := range self.candidates() {
+		if session, ctrl, err = u.tunnel.Bind(remote); err == nil {
+			self.recover(u)
+			return
+		}
+
+		var connectErr *ConnectError
+		if errors.As(err, &connectErr) || err == ErrBindNeedsMux {
+			return
+		}
+
+		self.eject(u, err)
+	}
+
+	return
+}
@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func setValue(field reflect.Value, typ reflect.Type, source string, sourceKey string, defaultValue string) {
@@ -38,6 +39,14 @@ func setValue(field reflect.Value, typ reflect.Type, source string, sourceKey st
 		value = defaultValue
 	}
 
+	if typ == reflect.TypeOf(time.Duration(0)) {
+		v, e := time.ParseDuration(value)
+		if e == nil {
+			field.SetInt(int64(v))
+		}
+		return
+	}
+
 	switch kind {
 	case reflect.Int8:
 		v, e := strconv.ParseInt(value, 10, 8)
@@ -93,9 +102,10 @@ func setValue(field reflect.Value, typ reflect.Type, source string, sourceKey st
 // Example:
 //
 //	type Config struct {
-//		MyConnStr         string `env:"MY_CONN_STR"`
-//		SomeFeatureToggle bool   `env:"ENABLE_FOO" default:"true"`
-//		ByteArr           []byte `sec:"SECRET_NAME"`
+//		MyConnStr         string        `env:"MY_CONN_STR"`
+//		SomeFeatureToggle bool          `env:"ENABLE_FOO" default:"true"`
+//		ByteArr           []byte        `sec:"SECRET_NAME"`
+//		Timeout           time.Duration `env:"TIMEOUT" default:"10s"`
 //	}
 //
 //	config := conf.LoadConfig()
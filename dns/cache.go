@@ -0,0 +1,109 @@
+package dns
+
+import (
+	"sync"
+	"time"
+)
+
+type cacheEntry struct {
+	response []byte
+	stored   time.Time
+	expires  time.Time
+}
+
+// Cache holds responses by question until the lowest TTL of their records expires. Negative responses
+// are held by the SOA record of their authority section, and responses with no TTL are not held.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[Question]*cacheEntry
+}
+
+// NewCache returns a cache holding up to size responses
+func NewCache(size int) *Cache {
+	return &Cache{
+		size:    size,
+		entries: map[Question]*cacheEntry{},
+	}
+}
+
+// Get returns a copy of the response held for the question of query, with the ID of query and the TTLs
+// aged by the time held, or nil if none
+func (self *Cache) Get(query []byte) []byte {
+	q, _, err := ParseQuestion(query)
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	self.mu.Lock()
+	entry := self.entries[q]
+	if entry != nil && !now.Before(entry.expires) {
+		delete(self.entries, q)
+		entry = nil
+	}
+	self.mu.Unlock()
+
+	if entry == nil {
+		return nil
+	}
+
+	response := append([]byte{}, entry.response...)
+	SetID(response, ID(query))
+	AgeTTL(response, uint32(now.Sub(entry.stored)/time.Second))
+	return response
+}
+
+// Put holds response to query, if it is a successful or name error response with a TTL
+func (self *Cache) Put(query []byte, response []byte) {
+	q, _, err := ParseQuestion(query)
+	if err != nil || Truncated(response) {
+		return
+	}
+
+	if rcode := Rcode(response); rcode != RcodeSuccess && rcode != RcodeNameError {
+		return
+	}
+
+	if rq, _, err := ParseQuestion(response); err != nil || rq != q {
+		return
+	}
+
+	ttl, ok, err := MinTTL(response)
+	if err != nil || !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	entry := &cacheEntry{
+		response: append([]byte{}, response...),
+		stored:   now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if _, ok := self.entries[q]; !ok && len(self.entries) >= self.size {
+		self.evict(now)
+	}
+
+	self.entries[q] = entry
+}
+
+// evict drops expired entries, or else an arbitrary one, to make room for a new entry
+func (self *Cache) evict(now time.Time) {
+	for q, entry := range self.entries {
+		if !now.Before(entry.expires) {
+			delete(self.entries, q)
+		}
+	}
+
+	for q := range self.entries {
+		if len(self.entries) < self.size {
+			return
+		}
+		delete(self.entries, q)
+	}
+}
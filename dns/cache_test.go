@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestCachePut(t *testing.T) {
+	query, err := NewQuery(0x1234, "example.org", TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := record(nil, "", TypeA, ClassIN, 300, []byte{192, 0, 2, 1})
+	truncated := response(t, RcodeSuccess, [3]int{1, 0, 0}, a)
+	binary.BigEndian.PutUint16(truncated[2:], binary.BigEndian.Uint16(truncated[2:])|flagTruncated)
+	other, err := NewQuery(0x1234, "example.net", TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		query    []byte
+		response []byte
+		held     bool
+	}{
+		{"answer", query, response(t, RcodeSuccess, [3]int{1, 0, 0}, a), true},
+		{"name error", query, response(t, RcodeNameError, [3]int{0, 1, 0}, record(nil, "org", TypeSOA, ClassIN, 900, soa(30))), true},
+		{"no ttl", query, response(t, RcodeSuccess, [3]int{}), false},
+		{"zero ttl", query, response(t, RcodeSuccess, [3]int{1, 0, 0}, record(nil, "", TypeA, ClassIN, 0, []byte{192, 0, 2, 1})), false},
+		{"server failure", query, response(t, RcodeServerFailure, [3]int{1, 0, 0}, a), false},
+		{"truncated", query, truncated, false},
+		{"other question", other, response(t, RcodeSuccess, [3]int{1, 0, 0}, a), false},
+		{"malformed query", query[:HeaderSize], response(t, RcodeSuccess, [3]int{1, 0, 0}, a), false},
+		{"malformed response", query, response(t, RcodeSuccess, [3]int{1, 0, 0}, a[:len(a)-1]), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := NewCache(10)
+			cache.Put(test.query, test.response)
+
+			if held := cache.Get(test.query) != nil; held != test.held {
+				t.Fatalf("got held %v, want %v", held, test.held)
+			}
+		})
+	}
+}
+
+func TestCacheGet(t *testing.T) {
+	query, err := NewQuery(0x1234, "example.org", TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache(10)
+	cache.Put(query, response(t, RcodeSuccess, [3]int{1, 0, 0}, record(nil, "", TypeA, ClassIN, 300, []byte{192, 0, 2, 1})))
+	q, _, _ := ParseQuestion(query)
+
+	tests := []struct {
+		name string
+		held time.Duration
+		id   uint16
+		ttl  uint32
+	}{
+		{"fresh", 0, 0x1234, 300},
+		{"other id", 0, 0xbeef, 300},
+		{"aged", 100 * time.Second, 0x1234, 200},
+		{"expired", 300 * time.Second, 0x1234, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := cache.entries[q]
+			if entry == nil {
+				t.Fatal("response dropped")
+			}
+			entry.stored = time.Now().Add(-test.held)
+			entry.expires = entry.stored.Add(300 * time.Second)
+
+			SetID(query, test.id)
+			got := cache.Get(query)
+			if test.ttl == 0 {
+				if got != nil {
+					t.Fatal("got expired response")
+				}
+				return
+			}
+
+			if ID(got) != test.id {
+				t.Fatalf("got id %x, want %x", ID(got), test.id)
+			}
+
+			if ttl, _, _ := MinTTL(got); ttl != test.ttl {
+				t.Fatalf("got ttl %d, want %d", ttl, test.ttl)
+			}
+
+			// the response held is not aged in place
+			if ttl, _, _ := MinTTL(entry.response); ttl != 300 {
+				t.Fatalf("held response aged to %d", ttl)
+			}
+		})
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	cache := NewCache(2)
+	for _, name := range []string{"a.example", "b.example", "c.example"} {
+		query, err := NewQuery(1, name, TypeA)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := append([]byte{}, query...)
+		binary.BigEndian.PutUint16(msg[2:], flagResponse)
+		binary.BigEndian.PutUint16(msg[6:], 1)
+		msg = record(msg, "", TypeA, ClassIN, 300, []byte{192, 0, 2, 1})
+		cache.Put(query, msg)
+	}
+
+	if len(cache.entries) != 2 {
+		t.Fatalf("got %d responses held, want 2", len(cache.entries))
+	}
+}
@@ -0,0 +1,311 @@
+// Package dns parses just enough of DNS messages (RFC 1035) to relay and cache them
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	HeaderSize = 12
+	// MaxUdpSize is the largest response to a UDP query without EDNS (RFC 1035 section 4.2.1)
+	MaxUdpSize = 512
+
+	TypeA    uint16 = 1
+	TypeSOA  uint16 = 6
+	TypeAAAA uint16 = 28
+	TypeOPT  uint16 = 41
+	ClassIN  uint16 = 1
+
+	RcodeSuccess        = 0
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3
+	flagResponse        = 0x8000
+	flagTruncated       = 0x0200
+	flagRecursionWanted = 0x0100
+	flagRecursionAvail  = 0x0080
+	maxPointers         = 16
+)
+
+var ErrMalformedMessage = errors.New("Malformed DNS message")
+var ErrMessageTooLarge = errors.New("DNS message too large")
+
+// Question is the question section of a message with a single question
+type Question struct {
+	// Name is lower case, without the trailing dot
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+func ID(msg []byte) uint16 {
+	return binary.BigEndian.Uint16(msg)
+}
+
+func SetID(msg []byte, id uint16) {
+	binary.BigEndian.PutUint16(msg, id)
+}
+
+func Rcode(msg []byte) int {
+	return int(msg[3] & 0x0f)
+}
+
+func Truncated(msg []byte) bool {
+	return binary.BigEndian.Uint16(msg[2:])&flagTruncated != 0
+}
+
+func count(msg []byte, section int) int {
+	return int(binary.BigEndian.Uint16(msg[4+2*section:]))
+}
+
+// readName reads the possibly compressed name at off, and returns it with the offset past it
+func readName(msg []byte, off int) (name string, next int, err error) {
+	var b strings.Builder
+	next = -1
+	for pointers := 0; ; {
+		if off >= len(msg) {
+			return "", 0, ErrMalformedMessage
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.ToLower(b.String()), next, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || pointers == maxPointers {
+				return "", 0, ErrMalformedMessage
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			pointers++
+		case l&0xc0 != 0 || off+1+l > len(msg):
+			return "", 0, ErrMalformedMessage
+		default:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.Write(msg[off+1 : off+1+l])
+			off += 1 + l
+		}
+	}
+}
+
+// ParseQuestion returns the question of msg, and the offset past it. Messages with other than one question are malformed.
+func ParseQuestion(msg []byte) (q Question, next int, err error) {
+	if len(msg) < HeaderSize || count(msg, 0) != 1 {
+		return q, 0, ErrMalformedMessage
+	}
+
+	if q.Name, next, err = readName(msg, HeaderSize); err != nil {
+		return
+	}
+
+	if next+4 > len(msg) {
+		return q, 0, ErrMalformedMessage
+	}
+
+	q.Type = binary.BigEndian.Uint16(msg[next:])
+	q.Class = binary.BigEndian.Uint16(msg[next+2:])
+	return q, next + 4, nil
+}
+
+// Record is a resource record, where Data refers to msg
+type Record struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+	// Section is 1 for answer, 2 for authority and 3 for additional
+	Section int
+	// ttlOffset locates TTL in msg
+	ttlOffset int
+}
+
+// Records calls fn with each resource record of msg after the question, until fn returns false
+func Records(msg []byte, fn func(r *Record) bool) error {
+	_, off, err := ParseQuestion(msg)
+	if err != nil {
+		return err
+	}
+
+	for section := 1; section <= 3; section++ {
+		for i := count(msg, section); i > 0; i-- {
+			var r Record
+			if r.Name, off, err = readName(msg, off); err != nil {
+				return err
+			}
+
+			if off+10 > len(msg) {
+				return ErrMalformedMessage
+			}
+
+			r.Type = binary.BigEndian.Uint16(msg[off:])
+			r.Class = binary.BigEndian.Uint16(msg[off+2:])
+			r.TTL = binary.BigEndian.Uint32(msg[off+4:])
+			r.ttlOffset = off + 4
+			r.Section = section
+
+			l := int(binary.BigEndian.Uint16(msg[off+8:]))
+			off += 10
+			if off+l > len(msg) {
+				return ErrMalformedMessage
+			}
+			r.Data = msg[off : off+l]
+			off += l
+
+			if !fn(&r) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+// MinTTL returns the time msg may be cached for, the lowest TTL of its records. A negative response is cached
+// for the lesser of TTL and MINIMUM of its SOA record (RFC 2308 section 5). ok is false if msg has no TTL.
+func MinTTL(msg []byte) (ttl uint32, ok bool, err error) {
+	err = Records(msg, func(r *Record) bool {
+		if r.Type == TypeOPT {
+			// TTL of OPT holds flags
+			return true
+		}
+
+		t := r.TTL
+		if r.Type == TypeSOA && r.Section == 2 && len(r.Data) >= 4 {
+			t = min(t, binary.BigEndian.Uint32(r.Data[len(r.Data)-4:]))
+		}
+
+		if !ok || t < ttl {
+			ttl, ok = t, true
+		}
+		return true
+	})
+
+	return
+}
+
+// AgeTTL deducts elapsed seconds from TTLs of records of msg in place
+func AgeTTL(msg []byte, elapsed uint32) error {
+	return Records(msg, func(r *Record) bool {
+		if r.Type != TypeOPT {
+			binary.BigEndian.PutUint32(msg[r.ttlOffset:], r.TTL-min(r.TTL, elapsed))
+		}
+		return true
+	})
+}
+
+// UdpSize returns the largest response the sender of query takes over UDP, by its EDNS OPT record (RFC 6891)
+func UdpSize(query []byte) int {
+	size := MaxUdpSize
+	Records(query, func(r *Record) bool {
+		if r.Type == TypeOPT {
+			// CLASS of OPT holds the UDP payload size
+			size = max(size, int(r.Class))
+			return false
+		}
+		return true
+	})
+
+	return size
+}
+
+// reply returns a response to query with the question only
+func reply(query []byte, rcode int) ([]byte, error) {
+	_, next, err := ParseQuestion(query)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := append([]byte{}, query[:next]...)
+	flags := binary.BigEndian.Uint16(msg[2:])&(0x7800|flagRecursionWanted) | flagResponse | flagRecursionAvail | uint16(rcode)
+	binary.BigEndian.PutUint16(msg[2:], flags)
+	// question only
+	clear(msg[6:HeaderSize])
+	return msg, nil
+}
+
+// ServerFailure returns a SERVFAIL response to query
+func ServerFailure(query []byte) ([]byte, error) {
+	return reply(query, RcodeServerFailure)
+}
+
+// Truncate returns msg if it fits in size, or else msg with the question only and the TC flag set,
+// for the client to retry over TCP
+func Truncate(msg []byte, size int) []byte {
+	if len(msg) <= size {
+		return msg
+	}
+
+	_, next, err := ParseQuestion(msg)
+	if err != nil {
+		return msg[:HeaderSize]
+	}
+
+	ret := append([]byte{}, msg[:next]...)
+	binary.BigEndian.PutUint16(ret[2:], binary.BigEndian.Uint16(ret[2:])|flagTruncated)
+	clear(ret[6:HeaderSize])
+	return ret
+}
+
+// NewQuery returns a recursive query for name of type typ
+func NewQuery(id uint16, name string, typ uint16) ([]byte, error) {
+	msg := make([]byte, HeaderSize, HeaderSize+len(name)+6)
+	SetID(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], flagRecursionWanted)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, ErrMalformedMessage
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	msg = binary.BigEndian.AppendUint16(msg, ClassIN)
+	return msg, nil
+}
+
+// ReadTcp reads a message prefixed by its length, as carried over TCP (RFC 1035 section 4.2.2)
+func ReadTcp(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if len(msg) < HeaderSize {
+		return nil, ErrMalformedMessage
+	}
+
+	return msg, nil
+}
+
+// WriteTcp writes msg prefixed by its length
+func WriteTcp(w io.Writer, msg []byte) error {
+	if len(msg) > 0xffff {
+		return ErrMessageTooLarge
+	}
+
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
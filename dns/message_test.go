@@ -0,0 +1,305 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// record appends a resource record of name, compressed to the question name if empty
+func record(msg []byte, name string, typ, class uint16, ttl uint32, data []byte) []byte {
+	switch name {
+	case "":
+		msg = append(msg, 0xc0, HeaderSize)
+	case ".":
+		msg = append(msg, 0)
+	default:
+		for _, label := range bytes.Split([]byte(name), []byte(".")) {
+			msg = append(append(msg, byte(len(label))), label...)
+		}
+		msg = append(msg, 0)
+	}
+
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	msg = binary.BigEndian.AppendUint16(msg, class)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+// response returns a response to a query of example.org A, with the answer, authority and additional counts
+// of the records appended
+func response(t *testing.T, rcode int, counts [3]int, records ...[]byte) []byte {
+	msg, err := NewQuery(0x1234, "Example.ORG.", TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	binary.BigEndian.PutUint16(msg[2:], flagResponse|flagRecursionWanted|flagRecursionAvail|uint16(rcode))
+	for i, n := range counts {
+		binary.BigEndian.PutUint16(msg[6+2*i:], uint16(n))
+	}
+
+	for _, r := range records {
+		msg = append(msg, r...)
+	}
+	return msg
+}
+
+func soa(minimum uint32) []byte {
+	// mname, rname as root, then serial, refresh, retry, expire and minimum
+	data := make([]byte, 2, 22)
+	for _, v := range []uint32{1, 3600, 600, 86400, minimum} {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	return data
+}
+
+func TestParseQuestion(t *testing.T) {
+	query, err := NewQuery(1, "Example.ORG.", TypeAAAA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := func(qdcount uint16, tail ...byte) []byte {
+		msg := make([]byte, HeaderSize)
+		binary.BigEndian.PutUint16(msg[4:], qdcount)
+		return append(msg, tail...)
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want Question
+		next int
+		err  error
+	}{
+		{"query", query, Question{Name: "example.org", Type: TypeAAAA, Class: ClassIN}, len(query), nil},
+		{"empty", nil, Question{}, 0, ErrMalformedMessage},
+		{"short header", query[:HeaderSize-1], Question{}, 0, ErrMalformedMessage},
+		{"no question", header(0, 0, 0, 1, 0, 1), Question{}, 0, ErrMalformedMessage},
+		{"two questions", header(2, 0, 0, 1, 0, 1), Question{}, 0, ErrMalformedMessage},
+		{"name past end", header(1, 10, 'a', 'b'), Question{}, 0, ErrMalformedMessage},
+		{"no name end", header(1, 1, 'a'), Question{}, 0, ErrMalformedMessage},
+		{"pointer loop", header(1, 0xc0, HeaderSize), Question{}, 0, ErrMalformedMessage},
+		{"pointer past end", header(1, 0xc0, 0xff), Question{}, 0, ErrMalformedMessage},
+		{"truncated pointer", header(1, 0xc0), Question{}, 0, ErrMalformedMessage},
+		{"reserved label type", header(1, 0x40, 0, 0, 1, 0, 1), Question{}, 0, ErrMalformedMessage},
+		{"short type and class", query[:len(query)-1], Question{}, 0, ErrMalformedMessage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, next, err := ParseQuestion(test.msg)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+
+			if err == nil && (q != test.want || next != test.next) {
+				t.Fatalf("got %+v at %d, want %+v at %d", q, next, test.want, test.next)
+			}
+		})
+	}
+}
+
+func TestRecords(t *testing.T) {
+	answer := record(nil, "", TypeA, ClassIN, 300, []byte{192, 0, 2, 1})
+
+	tests := []struct {
+		name  string
+		msg   []byte
+		types []uint16
+		err   error
+	}{
+		{"answer", response(t, RcodeSuccess, [3]int{1, 0, 0}, answer), []uint16{TypeA}, nil},
+		{"count past end", response(t, RcodeSuccess, [3]int{2, 0, 0}, answer), []uint16{TypeA}, ErrMalformedMessage},
+		{"short record", response(t, RcodeSuccess, [3]int{1, 0, 0}, answer[:8]), nil, ErrMalformedMessage},
+		{"data length past end", response(t, RcodeSuccess, [3]int{1, 0, 0}, answer[:len(answer)-1]), nil, ErrMalformedMessage},
+		{"record pointer loop", response(t, RcodeSuccess, [3]int{1, 0, 0}, []byte{0xc0, HeaderSize + 17}), nil, ErrMalformedMessage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var types []uint16
+			err := Records(test.msg, func(r *Record) bool {
+				types = append(types, r.Type)
+				return true
+			})
+
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+
+			if len(types) != len(test.types) {
+				t.Fatalf("got records %v, want %v", types, test.types)
+			}
+		})
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	a := func(ttl uint32) []byte { return record(nil, "", TypeA, ClassIN, ttl, []byte{192, 0, 2, 1}) }
+	opt := record(nil, ".", TypeOPT, 4096, 0, nil)
+
+	tests := []struct {
+		name string
+		msg  []byte
+		ttl  uint32
+		ok   bool
+		err  error
+	}{
+		{"lowest answer", response(t, RcodeSuccess, [3]int{2, 0, 0}, a(300), a(60)), 60, true, nil},
+		{"no records", response(t, RcodeSuccess, [3]int{}), 0, false, nil},
+		{"opt only", response(t, RcodeSuccess, [3]int{0, 0, 1}, opt), 0, false, nil},
+		{"opt ignored", response(t, RcodeSuccess, [3]int{1, 0, 1}, a(300), opt), 300, true, nil},
+		{"soa minimum", response(t, RcodeNameError, [3]int{0, 1, 0}, record(nil, "org", TypeSOA, ClassIN, 900, soa(30))), 30, true, nil},
+		{"soa ttl", response(t, RcodeNameError, [3]int{0, 1, 0}, record(nil, "org", TypeSOA, ClassIN, 10, soa(30))), 10, true, nil},
+		{"malformed", response(t, RcodeSuccess, [3]int{1, 0, 0}, a(300)[:5]), 0, false, ErrMalformedMessage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ttl, ok, err := MinTTL(test.msg)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+
+			if err == nil && (ttl != test.ttl || ok != test.ok) {
+				t.Fatalf("got %d %v, want %d %v", ttl, ok, test.ttl, test.ok)
+			}
+		})
+	}
+}
+
+func TestAgeTTL(t *testing.T) {
+	msg := response(t, RcodeSuccess, [3]int{2, 0, 1},
+		record(nil, "", TypeA, ClassIN, 300, []byte{192, 0, 2, 1}),
+		record(nil, "", TypeA, ClassIN, 20, []byte{192, 0, 2, 2}),
+		// TTL of OPT holds the extended rcode and flags, which must be kept
+		record(nil, ".", TypeOPT, 4096, 0x8000, nil))
+
+	tests := []struct {
+		name    string
+		elapsed uint32
+		ttls    []uint32
+	}{
+		{"none", 0, []uint32{300, 20, 0x8000}},
+		{"some", 15, []uint32{285, 5, 0x8000}},
+		{"past ttl", 25, []uint32{275, 0, 0x8000}},
+		{"past all", 1000, []uint32{0, 0, 0x8000}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aged := append([]byte{}, msg...)
+			if err := AgeTTL(aged, test.elapsed); err != nil {
+				t.Fatal(err)
+			}
+
+			var ttls []uint32
+			Records(aged, func(r *Record) bool {
+				ttls = append(ttls, r.TTL)
+				return true
+			})
+
+			if len(ttls) != len(test.ttls) {
+				t.Fatalf("got TTLs %v, want %v", ttls, test.ttls)
+			}
+			for i := range ttls {
+				if ttls[i] != test.ttls[i] {
+					t.Fatalf("got TTLs %v, want %v", ttls, test.ttls)
+				}
+			}
+		})
+	}
+
+	malformed := response(t, RcodeSuccess, [3]int{1, 0, 0}, []byte{0xc0})
+	if err := AgeTTL(malformed, 1); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("got error %v on malformed message, want %v", err, ErrMalformedMessage)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	var answers [][]byte
+	for i := 0; i < 40; i++ {
+		answers = append(answers, record(nil, "", TypeA, ClassIN, 300, []byte{192, 0, 2, byte(i)}))
+	}
+	large := response(t, RcodeSuccess, [3]int{len(answers), 0, 0}, answers...)
+	question := response(t, RcodeSuccess, [3]int{})
+
+	malformed := make([]byte, MaxUdpSize+1)
+	binary.BigEndian.PutUint16(malformed[4:], 1)
+	malformed[HeaderSize] = 0xc0
+	malformed[HeaderSize+1] = HeaderSize
+
+	tests := []struct {
+		name      string
+		msg       []byte
+		size      int
+		want      []byte
+		truncated bool
+	}{
+		{"fits", large, len(large), large, false},
+		{"question only", large, MaxUdpSize, question, true},
+		{"malformed", malformed, MaxUdpSize, malformed[:HeaderSize], false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := Truncate(test.msg, test.size)
+			if len(got) > test.size {
+				t.Fatalf("got %d bytes, over %d", len(got), test.size)
+			}
+
+			if Truncated(got) != test.truncated {
+				t.Fatalf("got truncated %v, want %v", Truncated(got), test.truncated)
+			}
+
+			// the TC flag and counts aside, the truncated message is the question
+			got = append([]byte{}, got...)
+			binary.BigEndian.PutUint16(got[2:], binary.BigEndian.Uint16(got[2:])&^flagTruncated)
+			if !bytes.Equal(got, test.want) {
+				t.Fatalf("got % x, want % x", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReadTcp(t *testing.T) {
+	query, err := NewQuery(1, "example.org", TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var framed bytes.Buffer
+	if err = WriteTcp(&framed, query); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{"message", framed.Bytes(), nil},
+		{"empty", nil, errors.New("EOF")},
+		{"short length", framed.Bytes()[:1], errors.New("unexpected EOF")},
+		{"length past end", framed.Bytes()[:framed.Len()-1], errors.New("unexpected EOF")},
+		{"short header", []byte{0, 2, 0, 1}, ErrMalformedMessage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg, err := ReadTcp(bytes.NewReader(test.in))
+			switch {
+			case test.err == nil && err != nil:
+				t.Fatal(err)
+			case test.err != nil && (err == nil || err.Error() != test.err.Error()):
+				t.Fatalf("got error %v, want %v", err, test.err)
+			case err == nil && !bytes.Equal(msg, query):
+				t.Fatalf("got % x, want % x", msg, query)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From int
+	To   int
+}
+
+func (self PortRange) Contains(port int) bool {
+	return port >= self.From && port <= self.To
+}
+
+// ParsePorts parses a comma separated list of ports and port ranges, e.g. 80,443,8000-9000. * returns nil for all ports.
+func ParsePorts(s string) (ret []PortRange, err error) {
+	if s == "*" {
+		return nil, nil
+	}
+
+	for _, p := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(p, "-")
+		if !isRange {
+			to = from
+		}
+
+		var r PortRange
+		if r.From, err = strconv.Atoi(from); err != nil {
+			return
+		}
+		if r.To, err = strconv.Atoi(to); err != nil {
+			return
+		}
+
+		if r.From < 0 || r.To > 65535 || r.From > r.To {
+			return nil, fmt.Errorf("Invalid port range %s", p)
+		}
+
+		ret = append(ret, r)
+	}
+	return
+}
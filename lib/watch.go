@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileWatcher detects changes of files by modification time
+type FileWatcher struct {
+	mu       sync.Mutex
+	files    []string
+	modTimes map[string]time.Time
+}
+
+// NewFileWatcher watches files. Empty file names are ignored.
+func NewFileWatcher(files ...string) *FileWatcher {
+	ret := &FileWatcher{
+		modTimes: map[string]time.Time{},
+	}
+
+	for _, file := range files {
+		if file != "" {
+			ret.files = append(ret.files, file)
+		}
+	}
+
+	return ret
+}
+
+// Add watches more files
+func (self *FileWatcher) Add(files ...string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for _, file := range files {
+		if file != "" {
+			self.files = append(self.files, file)
+		}
+	}
+}
+
+// Mark records the current modification times, so Changed reports later changes only
+func (self *FileWatcher) Mark() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for _, file := range self.files {
+		if info, err := os.Stat(file); err == nil {
+			self.modTimes[file] = info.ModTime()
+		}
+	}
+}
+
+// Changed tells if any file was modified since last Mark
+func (self *FileWatcher) Changed() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for _, file := range self.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+
+		if !info.ModTime().Equal(self.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Watch polls files every interval until ctx is done, and calls onChange when any is modified
+func (self *FileWatcher) Watch(ctx context.Context, interval time.Duration, onChange func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if self.Changed() {
+				onChange()
+			}
+		}
+	}
+}
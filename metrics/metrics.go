@@ -0,0 +1,300 @@
+// Package metrics contains counters, gauges and histograms exposed in Prometheus text format
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type metric interface {
+	write(w *bufio.Writer, name string)
+}
+
+type entry struct {
+	name   string
+	help   string
+	typ    string
+	metric metric
+}
+
+// Registry holds metrics in the order they are registered
+type Registry struct {
+	mu      sync.Mutex
+	entries []entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (self *Registry) register(name string, help string, typ string, m metric) {
+	self.mu.Lock()
+	self.entries = append(self.entries, entry{name: name, help: help, typ: typ, metric: m})
+	self.mu.Unlock()
+}
+
+func (self *Registry) Counter(name string, help string) *Counter {
+	ret := &Counter{}
+	self.register(name, help, "counter", ret)
+	return ret
+}
+
+func (self *Registry) Gauge(name string, help string) *Gauge {
+	ret := &Gauge{}
+	self.register(name, help, "gauge", ret)
+	return ret
+}
+
+func (self *Registry) CounterVec(name string, help string, labels ...string) *CounterVec {
+	ret := &CounterVec{
+		labels: labels,
+		values: map[string]*labeledCounter{},
+	}
+	self.register(name, help, "counter", ret)
+	return ret
+}
+
+// Histogram creates a histogram with upper bounds of buckets in increasing order
+func (self *Registry) Histogram(name string, help string, buckets []float64) *Histogram {
+	ret := &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)),
+	}
+	self.register(name, help, "histogram", ret)
+	return ret
+}
+
+// WriteTo writes all metrics in Prometheus text exposition format
+func (self *Registry) WriteTo(w io.Writer) (n int64, err error) {
+	self.mu.Lock()
+	entries := self.entries
+	self.mu.Unlock()
+
+	cw := &countingWriter{writer: w}
+	bw := bufio.NewWriter(cw)
+
+	for _, e := range entries {
+		bw.WriteString("# HELP ")
+		bw.WriteString(e.name)
+		bw.WriteByte(' ')
+		bw.WriteString(strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(e.help))
+		bw.WriteString("\n# TYPE ")
+		bw.WriteString(e.name)
+		bw.WriteByte(' ')
+		bw.WriteString(e.typ)
+		bw.WriteByte('\n')
+		e.metric.write(bw, e.name)
+	}
+
+	err = bw.Flush()
+	return cw.n, err
+}
+
+func (self *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	self.WriteTo(w)
+}
+
+// Serve exposes the registry at /metrics on addr. Close the returned server to stop.
+func Serve(addr string, registry *Registry) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go server.Serve(listener)
+	return server, nil
+}
+
+type countingWriter struct {
+	writer io.Writer
+	n      int64
+}
+
+func (self *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = self.writer.Write(p)
+	self.n += int64(n)
+	return
+}
+
+func writeSample(w *bufio.Writer, name string, labels string, value string) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteByte('{')
+		w.WriteString(labels)
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(value)
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names []string, values []string) string {
+	var sb strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(labelValueEscaper.Replace(values[i]))
+		sb.WriteByte('"')
+	}
+	return sb.String()
+}
+
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (self *Counter) Inc() {
+	self.value.Add(1)
+}
+
+func (self *Counter) Add(n uint64) {
+	self.value.Add(n)
+}
+
+func (self *Counter) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", strconv.FormatUint(self.value.Load(), 10))
+}
+
+type Gauge struct {
+	value atomic.Int64
+}
+
+func (self *Gauge) Inc() {
+	self.value.Add(1)
+}
+
+func (self *Gauge) Dec() {
+	self.value.Add(-1)
+}
+
+func (self *Gauge) Set(v int64) {
+	self.value.Store(v)
+}
+
+func (self *Gauge) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", strconv.FormatInt(self.value.Load(), 10))
+}
+
+type labeledCounter struct {
+	Counter
+	labels string
+}
+
+// CounterVec is a set of counters partitioned by label values
+type CounterVec struct {
+	mu     sync.RWMutex
+	labels []string
+	values map[string]*labeledCounter
+}
+
+// With returns the counter of label values, which must be given in the order of label names
+func (self *CounterVec) With(values ...string) *Counter {
+	key := strings.Join(values, "\xff")
+
+	self.mu.RLock()
+	c, ok := self.values[key]
+	self.mu.RUnlock()
+
+	if ok {
+		return &c.Counter
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if c, ok = self.values[key]; !ok {
+		c = &labeledCounter{labels: formatLabels(self.labels, values)}
+		self.values[key] = c
+	}
+
+	return &c.Counter
+}
+
+func (self *CounterVec) write(w *bufio.Writer, name string) {
+	self.mu.RLock()
+	counters := make([]*labeledCounter, 0, len(self.values))
+	for _, c := range self.values {
+		counters = append(counters, c)
+	}
+	self.mu.RUnlock()
+
+	sort.Slice(counters, func(i, j int) bool {
+		return counters[i].labels < counters[j].labels
+	})
+
+	for _, c := range counters {
+		writeSample(w, name, c.labels, strconv.FormatUint(c.value.Load(), 10))
+	}
+}
+
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	// float64 bits of sum
+	sum atomic.Uint64
+}
+
+func (self *Histogram) Observe(v float64) {
+	for i, bound := range self.buckets {
+		if v <= bound {
+			self.counts[i].Add(1)
+			break
+		}
+	}
+
+	self.count.Add(1)
+
+	for {
+		old := self.sum.Load()
+		if self.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (self *Histogram) write(w *bufio.Writer, name string) {
+	var cumulative uint64
+	for i, bound := range self.buckets {
+		cumulative += self.counts[i].Load()
+		writeSample(w, name+"_bucket", `le="`+formatFloat(bound)+`"`, strconv.FormatUint(cumulative, 10))
+	}
+
+	count := self.count.Load()
+	writeSample(w, name+"_bucket", `le="+Inf"`, strconv.FormatUint(count, 10))
+	writeSample(w, name+"_sum", "", formatFloat(math.Float64frombits(self.sum.Load())))
+	writeSample(w, name+"_count", "", strconv.FormatUint(count, 10))
+}
+
+// DefaultLatencyBuckets are upper bounds in seconds suitable for network latency
+var DefaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
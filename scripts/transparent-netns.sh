@@ -0,0 +1,99 @@
+#!/usr/bin/env bash
+# Tests transparent mode of buggy-client with REDIRECT and TPROXY, for an app in a network namespace.
+# Requires root, iproute2, iptables, openssl, curl and python3. Run from the repository root:
+#
+#	sudo scripts/transparent-netns.sh
+#
+# The app reaches an origin server on 198.51.100.10:8000 through buggy-client and buggy-server on this host,
+# and connecting to the listener of buggy-client directly is rejected instead of looping.
+set -euo pipefail
+
+NS=buggy-app
+ORIGIN=198.51.100.10
+WORK=$(mktemp -d)
+PIDS=()
+
+cleanup() {
+	for pid in "${PIDS[@]}"; do
+		kill "$pid" 2>/dev/null || true
+	done
+	iptables -t nat -D PREROUTING -i veth-buggy -p tcp -j REDIRECT --to-ports 12345 2>/dev/null || true
+	iptables -t mangle -D PREROUTING -i veth-buggy -p tcp -j TPROXY --on-port 12346 --tproxy-mark 1 2>/dev/null || true
+	ip rule del fwmark 1 lookup 100 2>/dev/null || true
+	ip route del local 0.0.0.0/0 dev lo table 100 2>/dev/null || true
+	ip addr del "$ORIGIN/32" dev lo 2>/dev/null || true
+	ip link del veth-buggy 2>/dev/null || true
+	ip netns del "$NS" 2>/dev/null || true
+	rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+fail() {
+	echo "FAIL: $*" >&2
+	exit 1
+}
+
+go build -o "$WORK/buggy-server" ./server
+go build -o "$WORK/buggy-client" ./client
+
+cd "$WORK"
+openssl req -x509 -newkey ec -pkeyopt ec_paramgen_curve:P-256 -nodes -keyout ca.key -out ca.pem -days 1 -subj /CN=ca 2>/dev/null
+openssl req -newkey ec -pkeyopt ec_paramgen_curve:P-256 -nodes -keyout server.key -out server.csr -subj /CN=localhost 2>/dev/null
+printf "subjectAltName=DNS:localhost\nextendedKeyUsage=serverAuth\n" > server.ext
+openssl x509 -req -in server.csr -CA ca.pem -CAkey ca.key -CAcreateserial -out server.pem -days 1 -extfile server.ext 2>/dev/null
+openssl req -newkey ec -pkeyopt ec_paramgen_curve:P-256 -nodes -keyout client.key -out client.csr -subj /CN=app 2>/dev/null
+printf "extendedKeyUsage=clientAuth\n" > client.ext
+openssl x509 -req -in client.csr -CA ca.pem -CAkey ca.key -CAcreateserial -out client.pem -days 1 -extfile client.ext 2>/dev/null
+
+# app namespace, routed through this host
+ip netns add "$NS"
+ip link add veth-buggy type veth peer name veth-app
+ip link set veth-app netns "$NS"
+ip addr add 10.200.0.1/24 dev veth-buggy
+ip link set veth-buggy up
+ip netns exec "$NS" ip addr add 10.200.0.2/24 dev veth-app
+ip netns exec "$NS" ip link set veth-app up
+ip netns exec "$NS" ip link set lo up
+ip netns exec "$NS" ip route add default via 10.200.0.1
+
+# origin server, reachable from this host only
+ip addr add "$ORIGIN/32" dev lo
+echo origin > index.html
+python3 -m http.server --bind "$ORIGIN" 8000 > origin.log 2>&1 &
+PIDS+=($!)
+
+LISTEN_ADDR=127.0.0.1:18443 CLIENT_ROOT_CA=ca.pem SERVER_CERT=server.pem SERVER_KEY=server.key \
+	./buggy-server > server.log 2>&1 &
+PIDS+=($!)
+
+client() {
+	LISTEN_ADDR=$1 MODE=transparent TPROXY=$2 ROOT_CA=ca.pem CLIENT_CERT=client.pem CLIENT_KEY=client.key \
+		REMOTE_URL=https://localhost:18443 ./buggy-client > "client-$2.log" 2>&1 &
+	PIDS+=($!)
+}
+
+client 0.0.0.0:12345 false
+client 0.0.0.0:12346 true
+sleep 1
+
+# check <name> <port>: the app reaches the origin, and is rejected connecting to the listener
+check() {
+	local body code=0
+	body=$(ip netns exec "$NS" curl -sS --max-time 5 "http://$ORIGIN:8000/") || fail "$1: origin unreachable"
+	[ "$body" = origin ] || fail "$1: unexpected body $body"
+
+	ip netns exec "$NS" curl -sS --max-time 5 "http://10.200.0.1:$2/" > /dev/null 2>&1 || code=$?
+	# 52 is an empty reply, as the connection is closed without relaying it
+	[ "$code" = 52 ] || fail "$1: connecting to the listener gave curl exit code $code"
+
+	echo "PASS: $1"
+}
+
+iptables -t nat -A PREROUTING -i veth-buggy -p tcp -j REDIRECT --to-ports 12345
+check redirect 12345
+iptables -t nat -D PREROUTING -i veth-buggy -p tcp -j REDIRECT --to-ports 12345
+
+iptables -t mangle -A PREROUTING -i veth-buggy -p tcp -j TPROXY --on-port 12346 --tproxy-mark 1
+ip rule add fwmark 1 lookup 100
+ip route add local 0.0.0.0/0 dev lo table 100
+check tproxy 12346
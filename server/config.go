@@ -1,8 +1,70 @@
 package main
 
+import "time"
+
 type Config struct {
-	ListenAddr   string `env:"LISTEN_ADDR"`
+	ListenAddr string `env:"LISTEN_ADDR"`
+	// ClientRootCA verifies client certificates. Required.
 	ClientRootCA string `env:"CLIENT_ROOT_CA"`
 	ServerCert   string `env:"SERVER_CERT" default:"/etc/buggy/server.pem"`
 	ServerKey    string `env:"SERVER_KEY" default:"/etc/buggy/server.key"`
+	// CertReloadInterval is how often cert, key, CA and revocation files are checked for change. 0 to only reload on SIGHUP.
+	CertReloadInterval time.Duration `env:"CERT_RELOAD_INTERVAL" default:"30s"`
+	// CrlFile lists revoked client certificates, signed by a CA of ClientRootCA. Reloaded on change. Clients are
+	// rejected once it expires until it is replaced.
+	CrlFile string `env:"CRL_FILE"`
+	// RevokedFile lists serial numbers or SPKI hashes of revoked client certificates. Reloaded on change.
+	RevokedFile string `env:"REVOKED_FILE"`
+	// OcspStapleFile is a DER encoded OCSP response of ServerCert, stapled to handshakes. It must be signed for the
+	// issuer of ServerCert, which ServerCert must hold after the certificate, report ServerCert good and be current.
+	// It is no longer stapled once it expires. Reloaded on change.
+	OcspStapleFile string `env:"OCSP_STAPLE_FILE"`
+	// PolicyFile lists allow / deny rules on destinations. Empty allows all destinations.
+	PolicyFile string `env:"POLICY_FILE"`
+	// IdentityFile maps client certificate identities to policy and bandwidth. Empty allows all clients.
+	IdentityFile string `env:"IDENTITY_FILE"`
+	// SniRoutes is a comma separated list of host_glob->host:port. TLS clients asking for a matching server name
+	// are passed through to the backend without terminating TLS. Others go through the mTLS tunnel.
+	SniRoutes string `env:"SNI_ROUTES"`
+	// ReverseBindHost is the address ports bound by reverse tunnels listen on. Empty for all interfaces.
+	ReverseBindHost string `env:"REVERSE_BIND_HOST"`
+	// ReverseHttpAddr serves HTTP requests, routed to reverse tunnels by Host header, one request per connection,
+	// and TLS connections, passed through to reverse tunnels by SNI. Empty to disable.
+	ReverseHttpAddr string `env:"REVERSE_HTTP_ADDR"`
+	// Resolvers is a comma separated list of DNS servers resolving destinations, host:port or IP for port 53.
+	// Empty to use the system resolver.
+	Resolvers string `env:"RESOLVERS"`
+	// HostsFile overrides resolution of destinations, in the format of /etc/hosts
+	HostsFile string `env:"HOSTS_FILE"`
+	// ResolverCacheSize is the max number of names cached. 0 to disable the cache.
+	ResolverCacheSize int `env:"RESOLVER_CACHE_SIZE" default:"4096"`
+	// ResolverMaxTTL caps the time answers are cached. Answers of the system resolver carry no TTL, and are cached this long.
+	ResolverMaxTTL time.Duration `env:"RESOLVER_MAX_TTL" default:"5m"`
+	// ResolverNegativeTTL caps the time names not found are cached
+	ResolverNegativeTTL time.Duration `env:"RESOLVER_NEGATIVE_TTL" default:"30s"`
+	// DialFamily picks the addresses dialed of destinations: dual, ipv4, ipv6 or prefer-ipv6. dual starts with the
+	// family of the first address resolved, and both dual and prefer-ipv6 fall back to the other family.
+	DialFamily string `env:"DIAL_FAMILY" default:"dual"`
+	// DialFallbackDelay is the head start of each address of a destination over the next, racing connection
+	// attempts by Happy Eyeballs (RFC 8305). 0 to dial addresses one after another.
+	DialFallbackDelay time.Duration `env:"DIAL_FALLBACK_DELAY" default:"250ms"`
+	// DialSourceAddr is the source IP of connections to destinations, for multi-homed servers. Empty for any.
+	DialSourceAddr string `env:"DIAL_SOURCE_ADDR"`
+	// DialInterface binds connections to destinations to a network interface with SO_BINDTODEVICE.
+	// Linux only, and requires CAP_NET_RAW. Empty for any.
+	DialInterface string `env:"DIAL_INTERFACE"`
+	// MuxKeepAlive is the ping interval of multiplexed sessions. 0 to disable.
+	MuxKeepAlive time.Duration `env:"MUX_KEEPALIVE" default:"30s"`
+	// Timeouts. 0 for no limit.
+	DialTimeout      time.Duration `env:"DIAL_TIMEOUT" default:"10s"`
+	ResolverTimeout  time.Duration `env:"RESOLVER_TIMEOUT" default:"5s"`
+	HandshakeTimeout time.Duration `env:"HANDSHAKE_TIMEOUT" default:"10s"`
+	HeaderTimeout    time.Duration `env:"HEADER_TIMEOUT" default:"30s"`
+	IdleTimeout      time.Duration `env:"IDLE_TIMEOUT"`
+	UdpIdleTimeout   time.Duration `env:"UDP_IDLE_TIMEOUT" default:"1m"`
+	MaxLifetime      time.Duration `env:"MAX_LIFETIME"`
+	// DrainTimeout is how long connections may carry on after shutdown is signalled, before they are reset
+	DrainTimeout time.Duration `env:"DRAIN_TIMEOUT" default:"30s"`
+	// MetricsAddr serves Prometheus metrics at /metrics. Empty to disable.
+	MetricsAddr string `env:"METRICS_ADDR"`
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+var ErrHttpNotAbsoluteUrl = errors.New("Request target is not an absolute http URL")
+var ErrHttpMethodNotAllowed = errors.New("Method not allowed")
+
+var continueResponse []byte = []byte("HTTP/1.1 100 Continue\r\n\r\n")
+
+// allowedMethods are the methods accepted by buggy-server
+const allowedMethods = "CONNECT, BIND, GET, HEAD, POST, PUT, DELETE, OPTIONS, PATCH"
+
+// httpForwarder forwards plain HTTP requests from one client connection,
+// keeping the upstream connection open across requests to the same address.
+type httpForwarder struct {
+	handler  *Handler
+	policy   *Policy
+	upstream *tcp.TcpConn
+	address  string
+	// responded is true once the response to the current request has started
+	responded bool
+	// traffic of forwarded requests, where dst is the client
+	stats    tcp.SpliceStats
+	requests int
+	// target is the last origin server
+	target string
+}
+
+func connectionTokens(headers map[string]string) []string {
+	v, ok := headers["connection"]
+	if !ok {
+		return nil
+	}
+
+	ret := strings.Split(v, ",")
+	for i := range ret {
+		ret[i] = strings.ToLower(strings.TrimSpace(ret[i]))
+	}
+	return ret
+}
+
+func wantsClose(version string, headers map[string]string) bool {
+	keepAlive := version != "HTTP/1.0"
+
+	for _, token := range connectionTokens(headers) {
+		switch token {
+		case "close":
+			return true
+		case "keep-alive":
+			keepAlive = true
+		}
+	}
+
+	return !keepAlive
+}
+
+// removeHopByHop strips hop-by-hop and Proxy-* headers.
+// Transfer-Encoding is kept as the body is relayed with its original framing.
+func removeHopByHop(headers map[string]string) {
+	for _, token := range connectionTokens(headers) {
+		if token != "transfer-encoding" {
+			delete(headers, token)
+		}
+	}
+
+	delete(headers, "connection")
+	delete(headers, "keep-alive")
+	delete(headers, "te")
+	delete(headers, "upgrade")
+
+	for k := range headers {
+		if strings.HasPrefix(k, "proxy-") {
+			delete(headers, k)
+		}
+	}
+}
+
+func (self *httpForwarder) dial(address string) (*tcp.TcpConn, error) {
+	if self.upstream != nil && self.address == address {
+		return self.upstream, nil
+	}
+
+	self.Close()
+
+	conn, err := self.handler.Dialer.DialInspect(address, self.policy.Inspect)
+	if err != nil {
+		return nil, err
+	}
+
+	self.upstream = conn
+	self.address = address
+	return conn, nil
+}
+
+func (self *httpForwarder) Close() {
+	if self.upstream != nil {
+		self.upstream.Close()
+		self.upstream = nil
+		self.address = ""
+	}
+}
+
+// Forward sends request to the origin server in origin form and streams the response back to conn.
+// It returns false if conn must not be reused for another request.
+func (self *httpForwarder) Forward(conn tcp.Conn, request *tcp.HttpRequest) (keepAlive bool, err error) {
+	self.responded = false
+
+	switch request.Method {
+	case "GET", "HEAD", "POST", "PUT", "DELETE", "OPTIONS", "PATCH":
+	default:
+		return false, ErrHttpMethodNotAllowed
+	}
+
+	u, err := url.Parse(request.Url)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return false, ErrHttpNotAbsoluteUrl
+	}
+
+	addr, err := tcp.UrlToAddress(request.Url)
+	if err != nil {
+		return
+	}
+
+	length, chunked, err := tcp.HttpBodyLength(request.Headers)
+	if err != nil {
+		return
+	}
+
+	if chunked {
+		// Transfer-Encoding overrides Content-Length, which must not reach the origin server (RFC 9112 section 6.3)
+		delete(request.Headers, "content-length")
+	}
+
+	if length < 0 && !chunked {
+		// requests without framing headers have no body
+		length = 0
+	}
+
+	clientClose := wantsClose(request.Version, request.Headers)
+
+	// the client waiting for 100 Continue is answered here, as the body is sent before the origin server responds
+	expectContinue := strings.EqualFold(request.Headers["expect"], "100-continue") && request.Version != "HTTP/1.0"
+	delete(request.Headers, "expect")
+	upgrade := request.Headers["upgrade"]
+
+	removeHopByHop(request.Headers)
+	if upgrade != "" {
+		request.Headers["connection"] = "upgrade"
+		request.Headers["upgrade"] = upgrade
+	}
+
+	request.Headers["host"] = u.Host
+	request.Url = u.RequestURI()
+	request.Version = "HTTP/1.1"
+
+	up, err := self.dial(addr.Address)
+	if err != nil {
+		return
+	}
+
+	self.requests++
+	self.target = addr.Address
+
+	if err = tcp.WriteHttpRequest(up, request); err != nil {
+		self.Close()
+		return
+	}
+
+	if expectContinue && (length != 0 || chunked) {
+		if _, err = conn.Write(continueResponse); err == nil {
+			err = conn.Flush()
+		}
+
+		if err != nil {
+			self.Close()
+			return
+		}
+	}
+
+	n, err := tcp.CopyHttpBody(up, conn, length, chunked)
+	self.stats.DstToSrc += n
+	if err != nil {
+		self.stats.DstToSrcErr = err
+		self.Close()
+		return
+	}
+
+	if err = up.Flush(); err != nil {
+		self.Close()
+		return
+	}
+
+	for {
+		var response tcp.HttpResponse
+		err = tcp.RunWithTimeout(up, self.handler.HeaderTimeout, tcp.ErrHeaderTimeout, func() (err error) {
+			response, err = tcp.ParseHttpResponse(up)
+			return
+		})
+		if err != nil {
+			self.Close()
+			return
+		}
+
+		if response.StatusCode == 101 {
+			// protocol switched, hand both connections over to splice
+			self.upstream = nil
+			self.responded = true
+			defer up.Close()
+
+			if err = tcp.WriteHttpResponse(conn, &response); err != nil {
+				return
+			}
+
+			if err = conn.Flush(); err != nil {
+				return
+			}
+
+			var stats tcp.SpliceStats
+			stats, err = tcp.SpliceWithOptions(conn, up, self.handler.Splice)
+			self.stats.SrcToDst += stats.SrcToDst
+			self.stats.DstToSrc += stats.DstToSrc
+			self.stats.SrcClosedFirst = stats.SrcClosedFirst
+			self.stats.SrcToDstErr = stats.SrcToDstErr
+			self.stats.DstToSrcErr = stats.DstToSrcErr
+			return false, err
+		}
+
+		serverClose := wantsClose(response.Version, response.Headers)
+		removeHopByHop(response.Headers)
+		response.Version = "HTTP/1.1"
+
+		if response.StatusCode < 200 {
+			// interim response, final response follows
+			self.responded = true
+			if err = tcp.WriteHttpResponse(conn, &response); err != nil {
+				self.Close()
+				return
+			}
+
+			if err = conn.Flush(); err != nil {
+				self.Close()
+				return
+			}
+			continue
+		}
+
+		length, chunked, err = tcp.HttpBodyLength(response.Headers)
+		if err != nil {
+			self.Close()
+			return
+		}
+
+		if chunked {
+			delete(response.Headers, "content-length")
+		}
+
+		if request.Method == "HEAD" || response.StatusCode == 204 || response.StatusCode == 304 {
+			length, chunked = 0, false
+		}
+
+		// body delimited by connection close can only be relayed the same way
+		untilClose := length < 0 && !chunked
+		if clientClose || untilClose {
+			response.Headers["connection"] = "close"
+		}
+
+		self.responded = true
+		if err = tcp.WriteHttpResponse(conn, &response); err == nil {
+			n, err = tcp.CopyHttpBody(conn, up, length, chunked)
+			self.stats.SrcToDst += n
+			if err == nil {
+				err = conn.Flush()
+			}
+		}
+
+		if err != nil {
+			self.stats.SrcToDstErr = err
+		}
+
+		// body delimited by close ends with the origin server closing first
+		self.stats.SrcClosedFirst = untilClose || serverClose
+
+		if err != nil || serverClose || untilClose {
+			self.Close()
+		}
+
+		return err == nil && !clientClose && !untilClose, err
+	}
+}
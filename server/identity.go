@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+var ErrNoPeerCertificate = errors.New("No client certificate presented")
+var ErrIdentityNotAuthorized = errors.New("Client identity not authorized")
+
+// Identity of a client, taken from its verified certificate
+type Identity struct {
+	// ID is the SPIFFE style URI SAN if present, otherwise the subject CN
+	ID         string
+	CommonName string
+	DNSNames   []string
+	URIs       []string
+}
+
+func PeerIdentity(state *tls.ConnectionState) (*Identity, error) {
+	if len(state.PeerCertificates) == 0 {
+		return nil, ErrNoPeerCertificate
+	}
+
+	cert := state.PeerCertificates[0]
+	ret := &Identity{
+		ID:         cert.Subject.CommonName,
+		CommonName: cert.Subject.CommonName,
+		DNSNames:   cert.DNSNames,
+	}
+
+	for _, u := range cert.URIs {
+		ret.URIs = append(ret.URIs, u.String())
+	}
+
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			ret.ID = u.String()
+			break
+		}
+	}
+
+	return ret, nil
+}
+
+// matchGlob matches s against pattern, where * matches any sequence of characters including /
+func matchGlob(pattern string, s string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+
+	last := len(parts) - 1
+	for _, part := range parts[1:last] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+
+	return strings.HasSuffix(s, parts[last])
+}
+
+func (self *Identity) match(pattern string) bool {
+	if matchGlob(pattern, self.ID) || matchGlob(pattern, self.CommonName) {
+		return true
+	}
+
+	for _, v := range self.DNSNames {
+		if matchGlob(pattern, v) {
+			return true
+		}
+	}
+
+	for _, v := range self.URIs {
+		if matchGlob(pattern, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Profile is what an identity is allowed to do
+type Profile struct {
+	Policy *Policy
+	// Limiter is shared by all connections of the profile. nil for unlimited bandwidth.
+	Limiter *tcp.RateLimiter
+	// Binds are the ports and names the identity may bind for reverse tunnels. nil for none.
+	Binds *Binds
+}
+
+type identityEntry struct {
+	pattern string
+	profile *Profile
+}
+
+// Identities maps client identities to profiles. First matching entry wins,
+// and identities matching no entry are rejected.
+//
+// Each line of an identity file is an entry:
+//
+//	<identity glob> [policy=<policy file>] [bandwidth=<bytes per second>] [bind=<port,from-to,host glob,...>]
+//
+// The glob is matched against the client ID, subject CN, DNS SANs and URI SANs.
+// Entries without policy use the server wide policy. Only entries with bind may
+// bind reverse tunnels. Example:
+//
+//	spiffe://example.org/team-a policy=/etc/buggy/team-a.policy bandwidth=10485760
+//	*.ops.example.org           policy=/etc/buggy/ops.policy
+//	spiffe://example.org/dev/*  bind=9000-9100,*.dev.example.org
+//	*                           bandwidth=1048576
+type Identities struct {
+	entries []identityEntry
+}
+
+func LoadIdentities(file string, defaultPolicy *Policy) (ret *Identities, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	ret = &Identities{}
+	policies := map[string]*Policy{}
+	scanner := bufio.NewScanner(f)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		entry := identityEntry{
+			pattern: fields[0],
+			profile: &Profile{Policy: defaultPolicy},
+		}
+
+		for _, field := range fields[1:] {
+			k, v, _ := strings.Cut(field, "=")
+
+			switch k {
+			case "policy":
+				policy, ok := policies[v]
+				if !ok {
+					if policy, err = LoadPolicy(v); err != nil {
+						return nil, fmt.Errorf("%s:%d: %w", file, lineNo, err)
+					}
+					policies[v] = policy
+				}
+				entry.profile.Policy = policy
+			case "bandwidth":
+				bandwidth, e := strconv.ParseInt(v, 10, 64)
+				if e != nil || bandwidth <= 0 {
+					return nil, fmt.Errorf("%s:%d: invalid bandwidth %s", file, lineNo, v)
+				}
+				entry.profile.Limiter = tcp.NewRateLimiter(bandwidth)
+			case "bind":
+				if entry.profile.Binds, err = ParseBinds(v); err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", file, lineNo, err)
+				}
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown option %s", file, lineNo, field)
+			}
+		}
+
+		ret.entries = append(ret.entries, entry)
+	}
+
+	return ret, scanner.Err()
+}
+
+// Lookup returns the profile of identity, or nil if the identity is not authorized
+func (self *Identities) Lookup(identity *Identity) *Profile {
+	for i := range self.entries {
+		if identity.match(self.entries[i].pattern) {
+			return self.entries[i].profile
+		}
+	}
+
+	return nil
+}
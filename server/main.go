@@ -3,16 +3,23 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	stdlog "log"
 
 	"github.com/z-george-ma/buggy/v2/conf"
 	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/metrics"
 	"github.com/z-george-ma/buggy/v2/tcp"
 )
 
@@ -47,37 +54,289 @@ func main() {
 		return false
 	})
 
-	certPool := x509.NewCertPool()
-	cert, err := os.ReadFile(config.ClientRootCA)
+	if config.ClientRootCA == "" {
+		log.Err().Error(0, tcp.ErrNoClientCA)
+		return
+	}
+
+	certs, err := tcp.NewCertStore(config.ServerCert, config.ServerKey, config.ClientRootCA)
 	if err != nil {
 		log.Err().Error(0, err)
 		return
 	}
-	certPool.AppendCertsFromPEM(cert)
 
-	certs, err := tls.LoadX509KeyPair(config.ServerCert, config.ServerKey)
+	if config.OcspStapleFile != "" {
+		if err = certs.SetOCSPStaple(config.OcspStapleFile); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+	}
+
+	baseConfig := &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		MinVersion: tls.VersionTLS13,
+		// clients not asking for mux get one connection per stream
+		NextProtos: []string{tcp.MuxProtocol, "http/1.1"},
+	}
+
+	var revocation *Revocation
+	if config.CrlFile != "" || config.RevokedFile != "" {
+		if revocation, err = LoadRevocation(config.CrlFile, config.RevokedFile, config.ClientRootCA); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+		baseConfig.VerifyConnection = revocation.VerifyConnection
+	}
+
+	tlsConfig, err := certs.ServerConfig(baseConfig)
+	if err != nil {
+		log.Err().Error(0, err)
+		return
+	}
+
+	onReload := func(err error) {
+		if err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+		log.Info().Value("not_after", certs.Leaf().NotAfter.String()).Msg("Certificates reloaded")
+	}
+
+	onRevocationReload := func(err error) {
+		if err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+		log.Info().Msg("Revocation lists reloaded")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			onReload(certs.Reload())
+			if revocation != nil {
+				onRevocationReload(revocation.Reload())
+			}
+		}
+	}()
+
+	if config.CertReloadInterval > 0 {
+		go certs.Watch(sig, config.CertReloadInterval, onReload)
+		if revocation != nil {
+			go revocation.Watch(sig, config.CertReloadInterval, onRevocationReload)
+		}
+	}
+
+	sniRoutes, err := ParseSniRoutes(config.SniRoutes)
 	if err != nil {
 		log.Err().Error(0, err)
 		return
 	}
 
-	tlsConfig := tls.Config{
-		Certificates: []tls.Certificate{certs},
-		ClientCAs:    certPool,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		MinVersion:   tls.VersionTLS13,
+	var policy *Policy
+	if config.PolicyFile != "" {
+		if policy, err = LoadPolicy(config.PolicyFile); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+	}
+
+	var identities *Identities
+	if config.IdentityFile != "" {
+		if identities, err = LoadIdentities(config.IdentityFile, policy); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+	}
+
+	serverMetrics := NewMetrics()
+	if config.MetricsAddr != "" {
+		metricsServer, err := metrics.Serve(config.MetricsAddr, serverMetrics.Registry)
+		if err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+		defer metricsServer.Close()
 	}
 
+	server.Hooks = serverMetrics.ServerHooks()
+
 	tcpDialer := tcp.NewDialer(true, 8192, 0)
+	tcpDialer.Dialer.Timeout = config.DialTimeout
+	tcpDialer.Hooks = serverMetrics.DialerHooks()
+	tcpDialer.FallbackDelay = config.DialFallbackDelay
+	if tcpDialer.Family, err = tcp.ParseAddressFamily(config.DialFamily); err != nil {
+		log.Err().Error(0, err)
+		return
+	}
+
+	if config.DialSourceAddr != "" {
+		ip := net.ParseIP(config.DialSourceAddr)
+		if ip == nil {
+			log.Err().Error(0, fmt.Errorf("Malformed source address %s", config.DialSourceAddr))
+			return
+		}
+
+		if (ip.To4() != nil && tcpDialer.Family == tcp.FamilyIPv6) || (ip.To4() == nil && tcpDialer.Family == tcp.FamilyIPv4) {
+			log.Err().Error(0, fmt.Errorf("Source address %s cannot dial %s destinations", ip, config.DialFamily))
+			return
+		}
+		tcpDialer.Dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	if config.DialInterface != "" {
+		tcpDialer.Dialer.Control = tcp.BindToDeviceControl(config.DialInterface)
+	}
+
+	resolver := tcp.NewResolver(config.ResolverCacheSize)
+	resolver.Timeout = config.ResolverTimeout
+	resolver.MaxTTL = config.ResolverMaxTTL
+	resolver.NegativeTTL = config.ResolverNegativeTTL
+	for _, addr := range strings.Split(config.Resolvers, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+
+		if net.ParseIP(addr) != nil {
+			addr = net.JoinHostPort(addr, "53")
+		}
+		resolver.Servers = append(resolver.Servers, addr)
+	}
+
+	if config.HostsFile != "" {
+		if resolver.Hosts, err = tcp.LoadHosts(config.HostsFile); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+	}
+	// DNS queries leave from the source address and interface of connections to destinations
+	resolver.Dialer = tcpDialer.Dialer
+	tcpDialer.Resolver = resolver
+
+	handler := &Handler{
+		Dialer:         tcpDialer,
+		HeaderTimeout:  config.HeaderTimeout,
+		UdpIdleTimeout: config.UdpIdleTimeout,
+		Splice: tcp.SpliceOptions{
+			IdleTimeout: config.IdleTimeout,
+			MaxLifetime: config.MaxLifetime,
+		},
+		Metrics:  serverMetrics,
+		Reverses: NewReverses(config.ReverseBindHost),
+	}
 	server.OnConnect(func(ctx context.Context, tc *tcp.TcpConn) {
 		connLog := log.With().Value("client_ip", tc.TCPConn.RemoteAddr().String()).Logger()
-		conn := tcp.TlsBind(tc, &tlsConfig)
+
+		var conn *tcp.TlsConn
+		if sniRoutes == nil {
+			conn = tcp.TlsBind(tc, tlsConfig)
+		} else {
+			var hello []byte
+			var serverName string
+			err := tcp.RunWithTimeout(tc, config.HandshakeTimeout, tcp.ErrHandshakeTimeout, func() (err error) {
+				hello, serverName, err = tcp.PeekClientHello(tc)
+				return
+			})
+
+			if err != nil && err != tcp.ErrNotTls && err != tcp.ErrMalformedClientHello {
+				serverMetrics.HandshakeFailures.With(tcp.HandshakeErrorClass(err)).Inc()
+				connLog.Err().Error(0, err)
+				tc.Close()
+				return
+			}
+
+			if route := sniRoutes.Match(serverName); route != nil {
+				defer tc.Close()
+				connLog = connLog.With().Value("server_name", serverName).Logger()
+				if err := handler.HandlePassthrough(tc, hello, route, connLog); err != nil {
+					connLog.Err().Error(0, err)
+				}
+				return
+			}
+
+			// not for passthrough, the mTLS handshake replays the bytes peeked
+			conn = tcp.TlsBindReplay(tc, hello, tlsConfig)
+		}
 		defer conn.Close()
 
-		if err := HandleConnection(tcpDialer, conn); err != nil {
+		if err := conn.HandshakeTimeout(config.HandshakeTimeout); err != nil {
+			var revoked *RevokedError
+			if errors.As(err, &revoked) {
+				serverMetrics.HandshakeFailures.With("revoked").Inc()
+				connLog.Err().Value("serial", revoked.Serial).Error(0, err)
+				return
+			}
+
+			serverMetrics.HandshakeFailures.With(tcp.HandshakeErrorClass(err)).Inc()
+			connLog.Err().Error(0, err)
+			return
+		}
+
+		state := conn.Conn.ConnectionState()
+		identity, err := PeerIdentity(&state)
+		if err != nil {
 			connLog.Err().Error(0, err)
 			return
 		}
+
+		connLog = connLog.With().Value("client_id", identity.ID).Logger()
+
+		profile := &Profile{Policy: policy}
+		if identities != nil {
+			if profile = identities.Lookup(identity); profile == nil {
+				handler.reject(conn, ErrIdentityNotAuthorized)
+				connLog.Err().Error(0, ErrIdentityNotAuthorized)
+				return
+			}
+		}
+
+		client := &Client{ID: identity.ID, Policy: profile.Policy, Binds: profile.Binds, Logger: connLog}
+
+		handle := func(conn tcp.Conn) {
+			if profile.Limiter != nil {
+				conn = tcp.Throttle(conn, profile.Limiter)
+			}
+
+			if err := handler.HandleConnection(ctx, client, conn); err != nil {
+				connLog.Err().Error(0, err)
+			}
+		}
+
+		if state.NegotiatedProtocol != tcp.MuxProtocol {
+			handle(conn)
+			return
+		}
+
+		session := tcp.NewMuxSession(conn, false, config.MuxKeepAlive, 8192, 8192)
+		defer session.Close()
+		client.Session = session
+
+		// on drain, let streams in flight finish but take no new ones
+		stop := context.AfterFunc(ctx, func() {
+			session.GoAway()
+		})
+		defer stop()
+
+		var streams sync.WaitGroup
+		defer streams.Wait()
+
+		for {
+			stream, err := session.Accept()
+			if err != nil {
+				if err != tcp.ErrMuxSessionClosed && err != tcp.ErrMuxGoingAway && err != io.EOF {
+					connLog.Err().Error(0, err)
+				}
+				return
+			}
+
+			streams.Add(1)
+			go func() {
+				defer streams.Done()
+				defer stream.Close()
+				handle(stream)
+			}()
+		}
 	})
 
 	err = server.Start(context.Background(), "tcp", config.ListenAddr)
@@ -85,8 +344,63 @@ func main() {
 		log.Err().Error(0, err)
 		return
 	}
-	defer server.Close(context.Background())
+
+	servers := []*tcp.TcpServer{server}
+	if config.ReverseHttpAddr != "" {
+		reverseServer := tcp.NewServer(true, 8192, 0, func(err error) bool {
+			if _, ok := err.(*net.OpError); ok {
+				// accept deadline reached
+				return true
+			}
+
+			log.Err().Error(1, err)
+			return false
+		})
+
+		reverseServer.OnConnect(func(ctx context.Context, tc *tcp.TcpConn) {
+			defer tc.Close()
+			connLog := log.With().Value("remote_ip", tc.TCPConn.RemoteAddr().String()).Logger()
+
+			if err := handler.HandleReverse(tc, connLog); err != nil {
+				connLog.Err().Error(0, err)
+			}
+		})
+
+		if err = reverseServer.Start(context.Background(), "tcp", config.ReverseHttpAddr); err != nil {
+			log.Err().Error(0, err)
+			return
+		}
+		servers = append(servers, reverseServer)
+	}
 
 	<-sig.Done()
+
+	numConns := 0
+	for _, server := range servers {
+		numConns += server.NumConns()
+	}
+
+	log.Info().Value("connections", numConns).Msg("Draining connections")
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), config.DrainTimeout)
+	defer drainCancel()
+
+	var wg sync.WaitGroup
+	var reset atomic.Int64
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *tcp.TcpServer) {
+			defer wg.Done()
+			n := server.Shutdown(drainCtx, 5*time.Second, func(live int) {
+				log.Info().Value("connections", live).Msg("Draining connections")
+			})
+			reset.Add(int64(n))
+		}(server)
+	}
+	wg.Wait()
+
+	if n := reset.Load(); n > 0 {
+		log.Warn().Value("connections", n).Msg("Drain timeout reached, connections reset")
+	}
+
 	log.Info().Msg("Exiting application")
 }
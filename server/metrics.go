@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/metrics"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+type Metrics struct {
+	Registry            *metrics.Registry
+	ActiveConnections   *metrics.Gauge
+	AcceptedConnections *metrics.Counter
+	RejectedRequests    *metrics.CounterVec
+	HandshakeFailures   *metrics.CounterVec
+	DialDuration        *metrics.Histogram
+	DialFailures        *metrics.Counter
+	Bytes               *metrics.CounterVec
+	ClientConnections   *metrics.CounterVec
+	ClientBytes         *metrics.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	r := metrics.NewRegistry()
+
+	return &Metrics{
+		Registry:            r,
+		ActiveConnections:   r.Gauge("buggy_server_active_connections", "Number of open client connections."),
+		AcceptedConnections: r.Counter("buggy_server_accepted_connections_total", "Number of accepted client connections."),
+		RejectedRequests:    r.CounterVec("buggy_server_rejected_requests_total", "Number of requests answered with an error, by Proxy-Status error type.", "reason"),
+		HandshakeFailures:   r.CounterVec("buggy_server_tls_handshake_failures_total", "Number of failed TLS handshakes, by error class.", "class"),
+		DialDuration:        r.Histogram("buggy_server_dial_duration_seconds", "Time taken by successful dials to targets.", metrics.DefaultLatencyBuckets),
+		DialFailures:        r.Counter("buggy_server_dial_failures_total", "Number of failed dials to targets."),
+		Bytes:               r.CounterVec("buggy_server_bytes_total", "Bytes relayed between clients and targets, by direction.", "direction"),
+		ClientConnections:   r.CounterVec("buggy_server_client_connections_total", "Number of authenticated client connections, by client identity.", "client_id"),
+		ClientBytes:         r.CounterVec("buggy_server_client_bytes_total", "Bytes relayed for clients, by client identity and direction.", "client_id", "direction"),
+	}
+}
+
+func (self *Metrics) ServerHooks() tcp.ServerHooks {
+	return tcp.ServerHooks{
+		Accepted: func(*tcp.TcpConn) {
+			self.AcceptedConnections.Inc()
+			self.ActiveConnections.Inc()
+		},
+		Closed: func(*tcp.TcpConn) {
+			self.ActiveConnections.Dec()
+		},
+	}
+}
+
+func (self *Metrics) DialerHooks() tcp.DialerHooks {
+	return tcp.DialerHooks{
+		Dialed: func(address string, elapsed time.Duration, err error) {
+			if err != nil {
+				self.DialFailures.Inc()
+				return
+			}
+			self.DialDuration.Observe(elapsed.Seconds())
+		},
+	}
+}
+
+// addStats counts traffic of a client connection, where dst of stats is the client
+func (self *Metrics) addStats(clientID string, stats *tcp.SpliceStats) {
+	up, down := uint64(stats.DstToSrc), uint64(stats.SrcToDst)
+	self.Bytes.With("up").Add(up)
+	self.Bytes.With("down").Add(down)
+	self.ClientBytes.With(clientID, "up").Add(up)
+	self.ClientBytes.With(clientID, "down").Add(down)
+}
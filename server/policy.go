@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/z-george-ma/buggy/v2/lib"
+)
+
+var ErrPolicyDenied = errors.New("Destination denied by policy")
+
+type policyRule struct {
+	allow bool
+	glob  string
+	cidr  *net.IPNet
+	ports []lib.PortRange
+}
+
+// Policy is an ordered list of allow / deny rules on destinations.
+// First matching rule wins, and destinations matching no rule are denied.
+//
+// Each line of a policy file is a rule:
+//
+//	<allow|deny> <host glob|CIDR> [port,from-to,...]
+//
+// Example:
+//
+//	# metadata service and private ranges are never reachable
+//	deny  169.254.169.254/32
+//	deny  10.0.0.0/8
+//	allow *.example.com 443
+//	allow * 80,443,8000-9000
+//
+// CIDR rules are matched against every address the destination resolves to,
+// and only addresses allowed by the policy are dialed, without resolving the destination again.
+type Policy struct {
+	rules []policyRule
+}
+
+func LoadPolicy(file string) (ret *Policy, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	ret = &Policy{}
+	scanner := bufio.NewScanner(f)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if len(fields) < 2 || len(fields) > 3 || (fields[0] != "allow" && fields[0] != "deny") {
+			return nil, fmt.Errorf("%s:%d: malformed rule", file, lineNo)
+		}
+
+		rule := policyRule{allow: fields[0] == "allow"}
+
+		if _, cidr, e := net.ParseCIDR(fields[1]); e == nil {
+			rule.cidr = cidr
+		} else if _, e := path.Match(fields[1], ""); e == nil {
+			rule.glob = strings.ToLower(fields[1])
+		} else {
+			return nil, fmt.Errorf("%s:%d: malformed destination %s", file, lineNo, fields[1])
+		}
+
+		if len(fields) == 3 {
+			if rule.ports, err = lib.ParsePorts(fields[2]); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", file, lineNo, err)
+			}
+		}
+
+		ret.rules = append(ret.rules, rule)
+	}
+
+	return ret, scanner.Err()
+}
+
+func (self *policyRule) matchPort(port int) bool {
+	if len(self.ports) == 0 {
+		return true
+	}
+
+	for _, r := range self.ports {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Policy) allowed(host string, ip net.IP, port int) bool {
+	for i := range self.rules {
+		rule := &self.rules[i]
+		if !rule.matchPort(port) {
+			continue
+		}
+
+		if rule.cidr != nil {
+			if rule.cidr.Contains(ip) {
+				return rule.allow
+			}
+			continue
+		}
+
+		if ok, _ := path.Match(rule.glob, host); ok {
+			return rule.allow
+		}
+	}
+
+	return false
+}
+
+// Inspect returns the IPs of host the policy allows to dial on port, to be given to TcpDialer as InspectFunc.
+// A nil policy allows everything.
+func (self *Policy) Inspect(host string, port int, ips []net.IP) ([]net.IP, error) {
+	if self == nil {
+		return ips, nil
+	}
+
+	var ret []net.IP
+	for _, ip := range ips {
+		if self.allowed(host, ip, port) {
+			ret = append(ret, ip)
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil, ErrPolicyDenied
+	}
+
+	return ret, nil
+}
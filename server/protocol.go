@@ -1,39 +1,179 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
 
+	"github.com/z-george-ma/buggy/v2/log"
 	"github.com/z-george-ma/buggy/v2/tcp"
 )
 
+var ErrDrainDroppedRequest = errors.New("Request dropped, connection was reset for drain")
+
 var connectResponse []byte = []byte("HTTP/1.1 200 OK\r\n\r\n")
 
-func HandleConnection(dialer *tcp.TcpDialer, conn *tcp.TlsConn) (err error) {
-	if err = conn.Conn.Handshake(); err != nil {
-		return
+// Client is the authenticated peer of a connection
+type Client struct {
+	// ID is the identity of the client certificate
+	ID     string
+	Policy *Policy
+	// Binds are the ports and names the client may bind for reverse tunnels
+	Binds  *Binds
+	Logger log.Logger
+	// Session is the mux session of the client, nil if not multiplexed
+	Session *tcp.MuxSession
+}
+
+// logStats logs and counts traffic of a client connection, where dst of stats is the client
+func (self *Handler) logStats(client *Client, logger log.Logger, target string, stats *tcp.SpliceStats) {
+	self.Metrics.addStats(client.ID, stats)
+
+	closedFirst := "client"
+	if stats.SrcClosedFirst {
+		closedFirst = "target"
 	}
 
-	request, err := tcp.ParseHttpRequest(conn)
+	entry := logger.Info().
+		Value("target", target).
+		Value("bytes_up", stats.DstToSrc).
+		Value("bytes_down", stats.SrcToDst).
+		Value("duration_ms", stats.Duration.Milliseconds()).
+		Value("closed_first", closedFirst)
 
-	if request.Method != "CONNECT" {
-		err = fmt.Errorf("Method %s not supported", request.Method)
-		return
+	if stats.DstToSrcErr != nil {
+		entry = entry.Value("error_up", stats.DstToSrcErr.Error())
 	}
 
-	if _, err = conn.Write(connectResponse); err != nil {
-		return
+	if stats.SrcToDstErr != nil {
+		entry = entry.Value("error_down", stats.SrcToDstErr.Error())
 	}
 
-	if err = conn.Flush(); err != nil {
-		return
+	entry.Msg("Connection closed")
+}
+
+// Handler serves requests of client connections
+type Handler struct {
+	Dialer *tcp.TcpDialer
+	// HeaderTimeout limits the time to read request headers, including idle time between keep-alive requests
+	HeaderTimeout time.Duration
+	Splice        tcp.SpliceOptions
+	// UdpIdleTimeout ends UDP associations without datagrams in either direction. 0 for no limit.
+	UdpIdleTimeout time.Duration
+	Metrics        *Metrics
+	Reverses       *Reverses
+}
+
+// HandleConnection serves requests of conn. Once ctx is done, it returns when conn is idle between requests.
+func (self *Handler) HandleConnection(ctx context.Context, client *Client, conn tcp.Conn) (err error) {
+	self.Metrics.ClientConnections.With(client.ID).Inc()
+
+	forwarder := httpForwarder{handler: self, policy: client.Policy}
+	defer forwarder.Close()
+
+	start := time.Now()
+	defer func() {
+		if forwarder.requests > 0 {
+			forwarder.stats.Duration = time.Since(start)
+			logger := client.Logger.With().Value("requests", forwarder.requests).Logger()
+			self.logStats(client, logger, forwarder.target, &forwarder.stats)
+		}
+	}()
+
+	for first := true; ; first = false {
+		var request tcp.HttpRequest
+
+		// on drain, conn is reset while waiting for a request, but a request parsed is served
+		var mu sync.Mutex
+		var parsed, reset bool
+		stop := context.AfterFunc(ctx, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !parsed {
+				reset = true
+				conn.Reset()
+			}
+		})
+
+		err = tcp.RunWithTimeout(conn, self.HeaderTimeout, tcp.ErrHeaderTimeout, func() (err error) {
+			request, err = tcp.ParseHttpRequest(conn)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if parsed = err == nil; parsed && reset {
+				// the request was read in full, but conn was reset for drain before it could be served
+				err = ErrDrainDroppedRequest
+			}
+			return
+		})
+
+		draining := !stop()
+
+		mu.Lock()
+		wasReset := reset
+		mu.Unlock()
+
+		if wasReset && err != ErrDrainDroppedRequest {
+			// draining, and no request in flight
+			return nil
+		}
+
+		if err != nil {
+			switch {
+			case err == io.EOF, err == tcp.ErrHeaderTimeout && !first:
+				// client closed, e.g. after a health check, or left idle keep-alive connection
+				err = nil
+			case err == tcp.ErrHeaderTimeout, err == io.ErrUnexpectedEOF, err == ErrDrainDroppedRequest:
+				// connection is gone, nothing to answer
+			default:
+				self.reject(conn, err)
+			}
+			return
+		}
+
+		if isConnectUdp(&request) {
+			return self.handleConnectUdp(client, conn, &request)
+		}
+
+		switch request.Method {
+		case "CONNECT":
+			return self.handleConnect(client, conn, &request)
+		case "BIND":
+			return self.handleBind(ctx, client, conn, &request)
+		}
+
+		keepAlive, err := forwarder.Forward(conn, &request)
+		if err != nil && !forwarder.responded {
+			self.reject(conn, err)
+		}
+
+		if err != nil || !keepAlive || draining {
+			return err
+		}
 	}
+}
 
-	down, err := dialer.Dial(request.Url)
+func (self *Handler) handleConnect(client *Client, conn tcp.Conn, request *tcp.HttpRequest) (err error) {
+	down, err := self.Dialer.DialInspect(request.Url, client.Policy.Inspect)
 	if err != nil {
+		self.reject(conn, err)
 		return
 	}
 
 	defer down.Close()
 
-	return tcp.Splice(conn, down)
+	// only confirm the tunnel once upstream is connected
+	if _, err = conn.Write(connectResponse); err != nil {
+		return
+	}
+
+	if err = conn.Flush(); err != nil {
+		return
+	}
+
+	stats, err := tcp.SpliceWithOptions(conn, down, self.Splice)
+	self.logStats(client, client.Logger, request.Url, &stats)
+	return
 }
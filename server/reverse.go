@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/z-george-ma/buggy/v2/lib"
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+var ErrBindNotAllowed = errors.New("Bind not allowed for client identity")
+var ErrBindInUse = errors.New("Bind taken by another client")
+var ErrBindNeedsMux = errors.New("Bind requires a multiplexed session")
+var ErrNoReverseTunnel = errors.New("No reverse tunnel bound to host")
+
+// Binds are the ports and names a client may bind for reverse tunnels
+type Binds struct {
+	ports []lib.PortRange
+	// names are globs of host names
+	names []string
+}
+
+// ParseBinds parses a comma separated list of ports, port ranges and host name globs,
+// e.g. 8022,9000-9100,*.dev.example.com
+func ParseBinds(s string) (*Binds, error) {
+	ret := &Binds{}
+	for _, v := range strings.Split(s, ",") {
+		if v == "" {
+			continue
+		}
+
+		if v[0] >= '0' && v[0] <= '9' {
+			ports, err := lib.ParsePorts(v)
+			if err != nil {
+				return nil, err
+			}
+			ret.ports = append(ret.ports, ports...)
+			continue
+		}
+
+		ret.names = append(ret.names, strings.ToLower(v))
+	}
+	return ret, nil
+}
+
+func (self *Binds) allowPort(port int) bool {
+	if self == nil {
+		return false
+	}
+
+	for _, r := range self.ports {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Binds) allowName(name string) bool {
+	if self == nil {
+		return false
+	}
+
+	for _, pattern := range self.names {
+		if matchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseBind is a port or name bound by a client. Inbound connections are pushed down its mux session.
+type reverseBind struct {
+	client *Client
+	// listens on the bound port, nil for name binds
+	server *tcp.TcpServer
+}
+
+// Reverses tracks reverse tunnels bound by clients
+type Reverses struct {
+	// bindHost is the address port binds listen on, empty for all interfaces
+	bindHost string
+	mu       sync.Mutex
+	names    map[string]*reverseBind
+	ports    map[int]*reverseBind
+}
+
+func NewReverses(bindHost string) *Reverses {
+	return &Reverses{
+		bindHost: bindHost,
+		names:    map[string]*reverseBind{},
+		ports:    map[int]*reverseBind{},
+	}
+}
+
+func (self *Reverses) bindName(name string, bind *reverseBind) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if _, ok := self.names[name]; ok {
+		return ErrBindInUse
+	}
+
+	self.names[name] = bind
+	return nil
+}
+
+func (self *Reverses) releaseName(name string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.names, name)
+}
+
+func (self *Reverses) lookupName(name string) *reverseBind {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.names[name]
+}
+
+// bindPort listens on port, and serves inbound connections with handle
+func (self *Reverses) bindPort(port int, bind *reverseBind, handle func(context.Context, *tcp.TcpConn)) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if _, ok := self.ports[port]; ok {
+		return ErrBindInUse
+	}
+
+	bind.server = tcp.NewServer(true, 8192, 0, func(err error) bool {
+		// accept deadline reached on release, or listener failed
+		return true
+	})
+	bind.server.OnConnect(handle)
+
+	err := bind.server.Start(context.Background(), "tcp", net.JoinHostPort(self.bindHost, strconv.Itoa(port)))
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return ErrBindInUse
+	}
+
+	if err != nil {
+		return err
+	}
+
+	self.ports[port] = bind
+	return nil
+}
+
+// releasePort stops listening on port. Connections pushed down already are left running.
+func (self *Reverses) releasePort(port int) {
+	self.mu.Lock()
+	bind := self.ports[port]
+	delete(self.ports, port)
+	self.mu.Unlock()
+
+	if bind != nil {
+		bind.server.Close(context.Background())
+	}
+}
+
+// pushReverse opens a stream down the mux session of client and splices it with inbound conn.
+// request and hello, the bytes read off conn already, are sent down the stream first if not nil.
+func (self *Handler) pushReverse(client *Client, conn tcp.Conn, request *tcp.HttpRequest, hello []byte, target string, logger log.Logger) (err error) {
+	stream, err := client.Session.Open()
+	if err != nil {
+		return
+	}
+
+	defer stream.Close()
+
+	if request != nil {
+		if err = tcp.WriteHttpRequest(stream, request); err != nil {
+			return
+		}
+
+		if err = stream.Flush(); err != nil {
+			return
+		}
+	}
+
+	if hello != nil {
+		if _, err = stream.Write(hello); err != nil {
+			return
+		}
+
+		if err = stream.Flush(); err != nil {
+			return
+		}
+	}
+
+	stats, err := tcp.SpliceWithOptions(stream, conn, self.Splice)
+	stats.SrcToDst += int64(len(hello))
+	self.logStats(client, logger, target, &stats)
+	return
+}
+
+// handleBind binds the port or host name of request for client. Inbound connections are pushed down
+// the mux session of the client, until conn, the stream of the request, is closed.
+func (self *Handler) handleBind(ctx context.Context, client *Client, conn tcp.Conn, request *tcp.HttpRequest) (err error) {
+	if client.Session == nil {
+		self.reject(conn, ErrBindNeedsMux)
+		return ErrBindNeedsMux
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(request.Url, "."))
+	logger := client.Logger.With().Value("bind", name).Logger()
+	bind := &reverseBind{client: client}
+
+	port, e := strconv.Atoi(name)
+	if e == nil {
+		if port <= 0 || port > 65535 || !client.Binds.allowPort(port) {
+			err = ErrBindNotAllowed
+		} else if err = self.Reverses.bindPort(port, bind, func(ctx context.Context, tc *tcp.TcpConn) {
+			defer tc.Close()
+			connLog := logger.With().Value("remote_ip", tc.TCPConn.RemoteAddr().String()).Logger()
+
+			if err := self.pushReverse(client, tc, nil, nil, name, connLog); err != nil {
+				connLog.Err().Error(0, err)
+			}
+		}); err == nil {
+			defer self.Reverses.releasePort(port)
+		}
+	} else {
+		if !client.Binds.allowName(name) {
+			err = ErrBindNotAllowed
+		} else if err = self.Reverses.bindName(name, bind); err == nil {
+			defer self.Reverses.releaseName(name)
+		}
+	}
+
+	if err != nil {
+		self.reject(conn, fmt.Errorf("%w: %s", err, name))
+		return
+	}
+
+	if _, err = conn.Write(connectResponse); err != nil {
+		return
+	}
+
+	if err = conn.Flush(); err != nil {
+		return
+	}
+
+	logger.Info().Msg("Reverse tunnel bound")
+
+	// on drain, release the bind
+	stop := context.AfterFunc(ctx, func() {
+		conn.Reset()
+	})
+	defer stop()
+
+	// nothing is sent after BIND, the client closes the stream to release the bind
+	io.Copy(io.Discard, conn)
+
+	logger.Info().Msg("Reverse tunnel released")
+	return nil
+}
+
+// HandleReverse routes a public connection to the reverse tunnel bound to a name, by the server name of its
+// TLS ClientHello, or else by the Host header of its HTTP request. TLS is passed through untouched.
+func (self *Handler) HandleReverse(conn *tcp.TcpConn, logger log.Logger) (err error) {
+	var isTls bool
+	err = tcp.RunWithTimeout(conn, self.HeaderTimeout, tcp.ErrHeaderTimeout, func() (err error) {
+		isTls, err = tcp.IsTlsHandshake(conn)
+		return
+	})
+
+	if err != nil {
+		if err == io.EOF || err == tcp.ErrHeaderTimeout {
+			err = nil
+		}
+		return
+	}
+
+	if !isTls {
+		return self.HandleReverseHttp(conn, logger)
+	}
+
+	var hello []byte
+	var serverName string
+	err = tcp.RunWithTimeout(conn, self.HeaderTimeout, tcp.ErrHeaderTimeout, func() (err error) {
+		hello, serverName, err = tcp.PeekClientHello(conn)
+		return
+	})
+
+	if err != nil {
+		return
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	bind := self.Reverses.lookupName(name)
+	if bind == nil {
+		// nothing can be answered before the TLS handshake, the connection is just closed
+		return fmt.Errorf("%w: %s", ErrNoReverseTunnel, name)
+	}
+
+	logger = logger.With().Value("client_id", bind.client.ID).Value("bind", name).Logger()
+	return self.pushReverse(bind.client, conn, nil, hello, name, logger)
+}
+
+// HandleReverseHttp routes a public HTTP connection to the reverse tunnel bound to the name in its Host header.
+// The request is sent with Connection: close, so that the origin server answers no request after it.
+func (self *Handler) HandleReverseHttp(conn tcp.Conn, logger log.Logger) (err error) {
+	var request tcp.HttpRequest
+	err = tcp.RunWithTimeout(conn, self.HeaderTimeout, tcp.ErrHeaderTimeout, func() (err error) {
+		request, err = tcp.ParseHttpRequest(conn)
+		return
+	})
+
+	if err != nil {
+		if err != io.EOF && err != io.ErrUnexpectedEOF && err != tcp.ErrHeaderTimeout {
+			self.reject(conn, err)
+		}
+		return
+	}
+
+	host := request.Headers["host"]
+	if h, _, e := net.SplitHostPort(host); e == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	bind := self.Reverses.lookupName(host)
+	if bind == nil {
+		err = fmt.Errorf("%w: %s", ErrNoReverseTunnel, host)
+		self.reject(conn, err)
+		return
+	}
+
+	if request.Headers["upgrade"] == "" {
+		// requests after this one may be for another name, so the connection carries this one only
+		removeHopByHop(request.Headers)
+		request.Headers["connection"] = "close"
+	}
+
+	logger = logger.With().Value("client_id", bind.client.ID).Value("bind", host).Logger()
+	return self.pushReverse(bind.client, conn, &request, nil, host, logger)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/lib"
+)
+
+var ErrCrlNotTrusted = errors.New("CRL is not signed by a CA of CLIENT_ROOT_CA")
+var ErrCrlExpired = errors.New("CRL expired, revocations issued since may be missing")
+
+// RevokedError rejects a client certificate during handshake
+type RevokedError struct {
+	// Serial is the serial number of the revoked certificate in hex
+	Serial string
+	// Source is either crl or deny list
+	Source string
+}
+
+func (self *RevokedError) Error() string {
+	return fmt.Sprintf("Certificate %s revoked by %s", self.Serial, self.Source)
+}
+
+type revocationList struct {
+	// issuer subject and serial number of certificates revoked by CRL
+	crl map[string]struct{}
+	// serial numbers in hex of the deny list
+	serials map[string]struct{}
+	// sha256 of SubjectPublicKeyInfo of the deny list
+	spki map[[sha256.Size]byte]struct{}
+	// expires is the earliest next update of the CRLs, zero if none
+	expires time.Time
+}
+
+// Revocation rejects client certificates listed in a CRL file or a deny list file.
+//
+// The CRL file holds one or more PEM or a single DER encoded CRL, each signed by a CA of caFile.
+// The deny list file has one certificate per line, e.g.
+//
+//	serial 3a:0f:8e:21
+//	spki   <hex sha256 of SubjectPublicKeyInfo>
+type Revocation struct {
+	crlFile  string
+	denyFile string
+	caFile   string
+	watcher  *lib.FileWatcher
+	list     atomic.Pointer[revocationList]
+}
+
+func LoadRevocation(crlFile string, denyFile string, caFile string) (*Revocation, error) {
+	ret := &Revocation{
+		crlFile:  crlFile,
+		denyFile: denyFile,
+		caFile:   caFile,
+		watcher:  lib.NewFileWatcher(crlFile, denyFile, caFile),
+	}
+
+	if err := ret.Reload(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func crlKey(rawIssuer []byte, serial *big.Int) string {
+	return string(rawIssuer) + "/" + serial.Text(16)
+}
+
+func normalizeSerial(serial string) string {
+	return strings.TrimLeft(strings.ToLower(strings.ReplaceAll(serial, ":", "")), "0")
+}
+
+func (self *Revocation) loadCrl(list *revocationList) error {
+	data, err := os.ReadFile(self.crlFile)
+	if err != nil {
+		return err
+	}
+
+	caData, err := os.ReadFile(self.caFile)
+	if err != nil {
+		return err
+	}
+
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(caData); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		cas = append(cas, ca)
+	}
+
+	var ders [][]byte
+	if block, rest := pem.Decode(data); block != nil {
+		for ; block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+	} else {
+		ders = append(ders, data)
+	}
+
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return err
+		}
+
+		trusted := false
+		for _, ca := range cas {
+			if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+				trusted = true
+				break
+			}
+		}
+
+		if !trusted {
+			return ErrCrlNotTrusted
+		}
+
+		if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+			return fmt.Errorf("%w: %s at %s", ErrCrlExpired, crl.Issuer, crl.NextUpdate)
+		}
+
+		if !crl.NextUpdate.IsZero() && (list.expires.IsZero() || crl.NextUpdate.Before(list.expires)) {
+			list.expires = crl.NextUpdate
+		}
+
+		for _, entry := range crl.RevokedCertificateEntries {
+			list.crl[crlKey(crl.RawIssuer, entry.SerialNumber)] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+func (self *Revocation) loadDenyList(list *revocationList) error {
+	file, err := os.Open(self.denyFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expecting <serial|spki> <value>", self.denyFile, lineNo)
+		}
+
+		switch fields[0] {
+		case "serial":
+			list.serials[normalizeSerial(fields[1])] = struct{}{}
+		case "spki":
+			var hash [sha256.Size]byte
+			if b, err := hex.DecodeString(fields[1]); err != nil || len(b) != sha256.Size {
+				return fmt.Errorf("%s:%d: spki is not a hex sha256", self.denyFile, lineNo)
+			} else {
+				copy(hash[:], b)
+			}
+			list.spki[hash] = struct{}{}
+		default:
+			return fmt.Errorf("%s:%d: unknown entry %s", self.denyFile, lineNo, fields[0])
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Reload reads all files again. On error, the lists loaded before are kept.
+func (self *Revocation) Reload() error {
+	// a bad file is reported once, rather than on every poll
+	self.watcher.Mark()
+
+	list := &revocationList{
+		crl:     map[string]struct{}{},
+		serials: map[string]struct{}{},
+		spki:    map[[sha256.Size]byte]struct{}{},
+	}
+
+	if self.crlFile != "" {
+		if err := self.loadCrl(list); err != nil {
+			return err
+		}
+	}
+
+	if self.denyFile != "" {
+		if err := self.loadDenyList(list); err != nil {
+			return err
+		}
+	}
+
+	self.list.Store(list)
+	return nil
+}
+
+// Watch polls files every interval until ctx is done, and reloads them on change.
+// onReload is called with the result of each reload.
+func (self *Revocation) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	self.watcher.Watch(ctx, interval, func() {
+		onReload(self.Reload())
+	})
+}
+
+// Check returns *RevokedError if any certificate of chain but the root is revoked, or ErrCrlExpired once a CRL
+// expires without being replaced, as a stale CRL cannot vouch for any certificate.
+func (self *Revocation) Check(chain []*x509.Certificate) error {
+	list := self.list.Load()
+
+	if !list.expires.IsZero() && time.Now().After(list.expires) {
+		return fmt.Errorf("%w at %s", ErrCrlExpired, list.expires)
+	}
+
+	for i, cert := range chain {
+		if i > 0 && i == len(chain)-1 {
+			// root
+			break
+		}
+
+		serial := cert.SerialNumber.Text(16)
+
+		if _, ok := list.crl[crlKey(cert.RawIssuer, cert.SerialNumber)]; ok {
+			return &RevokedError{Serial: serial, Source: "crl"}
+		}
+
+		if _, ok := list.serials[normalizeSerial(serial)]; ok {
+			return &RevokedError{Serial: serial, Source: "deny list"}
+		}
+
+		if _, ok := list.spki[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+			return &RevokedError{Serial: serial, Source: "deny list"}
+		}
+	}
+
+	return nil
+}
+
+// VerifyConnection checks the verified chain of the client. It is meant for tls.Config.
+func (self *Revocation) VerifyConnection(state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		if err := self.Check(chain); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
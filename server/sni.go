@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/z-george-ma/buggy/v2/log"
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+// SniRoute sends TLS clients asking for a server name matching pattern to backend
+type SniRoute struct {
+	pattern string
+	backend string
+}
+
+// SniRoutes routes TLS clients by the server name of their ClientHello to backends, without terminating TLS.
+// First matching route wins, and server names matching no route go through the mTLS tunnel.
+type SniRoutes struct {
+	routes []SniRoute
+}
+
+// ParseSniRoutes parses a comma separated list of host_glob->host:port, e.g.
+//
+//	git.example.org->10.0.0.6:443,*.app.example.org->10.0.0.7:443
+func ParseSniRoutes(s string) (*SniRoutes, error) {
+	ret := &SniRoutes{}
+	for _, mapping := range strings.Split(s, ",") {
+		if mapping = strings.TrimSpace(mapping); mapping == "" {
+			continue
+		}
+
+		pattern, backend, ok := strings.Cut(mapping, "->")
+		if !ok {
+			return nil, fmt.Errorf("Malformed SNI route %s, expecting host_glob->host:port", mapping)
+		}
+
+		route := SniRoute{pattern: strings.ToLower(strings.TrimSpace(pattern)), backend: strings.TrimSpace(backend)}
+		if _, _, err := net.SplitHostPort(route.backend); err != nil {
+			return nil, fmt.Errorf("Malformed SNI route %s: %w", mapping, err)
+		}
+
+		ret.routes = append(ret.routes, route)
+	}
+
+	if len(ret.routes) == 0 {
+		return nil, nil
+	}
+
+	return ret, nil
+}
+
+// Match returns the route matching serverName, or nil if none
+func (self *SniRoutes) Match(serverName string) *SniRoute {
+	if serverName == "" {
+		return nil
+	}
+
+	serverName = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	for i := range self.routes {
+		if matchGlob(self.routes[i].pattern, serverName) {
+			return &self.routes[i]
+		}
+	}
+
+	return nil
+}
+
+// HandlePassthrough splices conn with the backend of route, replaying hello, the ClientHello read off conn
+func (self *Handler) HandlePassthrough(conn tcp.Conn, hello []byte, route *SniRoute, logger log.Logger) (err error) {
+	up, err := self.Dialer.Dial(route.backend)
+	if err != nil {
+		return
+	}
+
+	defer up.Close()
+
+	if _, err = up.Write(hello); err != nil {
+		return
+	}
+
+	if err = up.Flush(); err != nil {
+		return
+	}
+
+	// passthrough clients are anonymous, and counted by route
+	client := &Client{ID: "sni:" + route.pattern, Logger: logger}
+
+	stats, err := tcp.SpliceWithOptions(conn, up, self.Splice)
+	stats.DstToSrc += int64(len(hello))
+	self.logStats(client, logger, route.backend, &stats)
+	return
+}
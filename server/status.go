@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+// proxyStatus classifies err into a response status code and a RFC 9209 Proxy-Status error type
+func proxyStatus(err error) (statusCode int, errorType string) {
+	switch err {
+	case tcp.ErrHttpMalformedHeader, tcp.ErrExceedingHeaderCount, bufio.ErrBufferFull,
+		tcp.ErrHttpInvalidContentLength, tcp.ErrHttpUnsupportedTransferEncoding, ErrHttpNotAbsoluteUrl, ErrUdpMalformedTarget:
+		return 400, "http_request_error"
+	case ErrHttpMethodNotAllowed:
+		return 405, "http_request_denied"
+	case ErrPolicyDenied:
+		return 403, "destination_ip_prohibited"
+	case ErrIdentityNotAuthorized:
+		return 403, "http_request_denied"
+	}
+
+	switch {
+	case errors.Is(err, ErrBindNotAllowed):
+		return 403, "http_request_denied"
+	case errors.Is(err, ErrBindInUse):
+		return 409, "http_request_denied"
+	case errors.Is(err, ErrBindNeedsMux):
+		return 400, "http_request_error"
+	case errors.Is(err, ErrNoReverseTunnel):
+		return 502, "destination_not_found"
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsTimeout {
+			return 504, "dns_timeout"
+		}
+		return 502, "dns_error"
+	}
+
+	var addrErr *net.AddrError
+	if errors.As(err, &addrErr) {
+		return 400, "http_request_error"
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return 504, "connection_timeout"
+	}
+
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return 502, "connection_refused"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return 502, "destination_ip_unroutable"
+	case errors.Is(err, syscall.ECONNRESET):
+		return 502, "connection_terminated"
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return 502, "destination_unavailable"
+	}
+
+	return 502, "proxy_internal_error"
+}
+
+// writeError answers the request that failed with err, with Proxy-Status telling the error class.
+// err itself may reveal internal addresses or names, so it is left to the log of the caller.
+func writeError(conn tcp.Conn, err error) error {
+	statusCode, errorType := proxyStatus(err)
+	headers := map[string]string{
+		"proxy-status": "buggy; error=" + errorType,
+	}
+
+	if statusCode == 405 {
+		headers["allow"] = allowedMethods
+	}
+
+	return tcp.WriteHttpStatus(conn, statusCode, headers, errorType+"\n")
+}
+
+// reject answers the request that failed with err like writeError, and counts the rejection
+func (self *Handler) reject(conn tcp.Conn, err error) error {
+	_, errorType := proxyStatus(err)
+	self.Metrics.RejectedRequests.With(errorType).Inc()
+	return writeError(conn, err)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/tcp"
+)
+
+var ErrUdpMalformedTarget = errors.New("Malformed connect-udp target")
+
+// connectUdpPath is the path of the default URI template of connect-udp (RFC 9298)
+const connectUdpPath = "/.well-known/masque/udp/"
+
+// isConnectUdp tells if request asks to upgrade to connect-udp
+func isConnectUdp(request *tcp.HttpRequest) bool {
+	return strings.EqualFold(request.Headers["upgrade"], "connect-udp")
+}
+
+// connectUdpTarget returns host:port of a connect-udp request of the default URI template
+func connectUdpTarget(request *tcp.HttpRequest) (string, error) {
+	u, err := url.Parse(request.Url)
+	if err != nil {
+		return "", ErrUdpMalformedTarget
+	}
+
+	hostPort, ok := strings.CutPrefix(u.Path, connectUdpPath)
+	if !ok {
+		return "", ErrUdpMalformedTarget
+	}
+
+	host, port, _ := strings.Cut(strings.TrimSuffix(hostPort, "/"), "/")
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 || host == "" {
+		return "", ErrUdpMalformedTarget
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// relayUdp relays datagrams between capsules of conn and a UDP socket connected to the target, which is the
+// NAT mapping of the association. The association ends when conn is closed, or when no datagram passes in
+// either direction for idleTimeout.
+func relayUdp(conn tcp.Conn, udp *net.UDPConn, idleTimeout time.Duration) (stats tcp.SpliceStats, err error) {
+	start := time.Now()
+	var lastActive atomic.Int64
+	var stopped atomic.Bool
+	lastActive.Store(start.UnixNano())
+
+	upDone := make(chan error, 1)
+	go func() {
+		buf := make([]byte, tcp.MaxDatagramSize)
+		var err error
+		for {
+			var payload []byte
+			if payload, err = tcp.ReadDatagram(conn, buf); err != nil {
+				break
+			}
+
+			lastActive.Store(time.Now().UnixNano())
+			stats.DstToSrc += int64(len(payload))
+			// datagrams may be lost, so write errors, e.g. ICMP unreachable, do not end the association
+			udp.Write(payload)
+		}
+
+		stopped.Store(true)
+		udp.SetReadDeadline(time.Now())
+		upDone <- err
+	}()
+
+	buf := make([]byte, tcp.MaxDatagramSize)
+relay:
+	for {
+		if idleTimeout > 0 {
+			udp.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		n, e := udp.Read(buf)
+		if e != nil {
+			var netErr net.Error
+			switch {
+			case stopped.Load():
+			case errors.Is(e, syscall.ECONNREFUSED):
+				// ICMP port unreachable of an earlier datagram
+				continue
+			case errors.As(e, &netErr) && netErr.Timeout():
+				if time.Since(time.Unix(0, lastActive.Load())) < idleTimeout {
+					continue
+				}
+				err = tcp.ErrIdleTimeout
+				stats.SrcClosedFirst = true
+			default:
+				err = e
+				stats.SrcClosedFirst = true
+			}
+			break relay
+		}
+
+		lastActive.Store(time.Now().UnixNano())
+		stats.SrcToDst += int64(n)
+		if e = tcp.WriteDatagram(conn, buf[:n]); e == nil {
+			e = conn.Flush()
+		}
+
+		if e != nil {
+			stats.SrcToDstErr = e
+			break
+		}
+	}
+
+	resetByUs := !stopped.Load()
+	if resetByUs {
+		// end the association, which unblocks reading capsules
+		conn.Reset()
+	}
+
+	if e := <-upDone; !resetByUs && e != io.EOF {
+		stats.DstToSrcErr = e
+	}
+
+	stats.Duration = time.Since(start)
+	return
+}
+
+// handleConnectUdp serves a connect-udp request, relaying datagrams of conn with the target
+func (self *Handler) handleConnectUdp(client *Client, conn tcp.Conn, request *tcp.HttpRequest) (err error) {
+	target, err := connectUdpTarget(request)
+	if err != nil {
+		self.reject(conn, err)
+		return
+	}
+
+	addresses, err := self.Dialer.Resolve(context.Background(), target, client.Policy.Inspect)
+	if err != nil {
+		self.reject(conn, err)
+		return
+	}
+
+	udp, err := self.Dialer.DialUdp(addresses)
+	if err != nil {
+		self.reject(conn, err)
+		return
+	}
+
+	defer udp.Close()
+
+	response := tcp.HttpResponse{
+		StatusCode: 101,
+		Reason:     "Switching Protocols",
+		Version:    "HTTP/1.1",
+		Headers: map[string]string{
+			"connection":       "Upgrade",
+			"upgrade":          "connect-udp",
+			"capsule-protocol": "?1",
+		},
+	}
+
+	if err = tcp.WriteHttpResponse(conn, &response); err != nil {
+		return
+	}
+
+	if err = conn.Flush(); err != nil {
+		return
+	}
+
+	stats, err := relayUdp(conn, udp, self.UdpIdleTimeout)
+	self.logStats(client, client.Logger.With().Value("protocol", "udp").Logger(), target, &stats)
+
+	if err == tcp.ErrIdleTimeout {
+		// idle associations are expected to end this way
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,117 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+)
+
+// HTTP Datagrams (RFC 9297) are carried over a stream as DATAGRAM capsules:
+// type(varint) length(varint) context id(varint) payload. connect-udp (RFC 9298) uses context id 0 for UDP payloads.
+const (
+	capsuleDatagram = 0x00
+	// MaxDatagramSize is the largest UDP payload
+	MaxDatagramSize = 65535
+)
+
+var ErrCapsuleTooLarge = errors.New("Capsule exceeds max datagram size")
+var ErrMalformedVarint = errors.New("Malformed variable-length integer")
+
+// appendVarint appends v as a QUIC variable-length integer (RFC 9000 section 16)
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func readVarint(r Reader) (v uint64, n int, err error) {
+	var buf [8]byte
+	if _, err = r.ReadFull(buf[:1]); err != nil {
+		return
+	}
+
+	n = 1 << (buf[0] >> 6)
+	if n > 1 {
+		if _, err = r.ReadFull(buf[1:n]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+
+	v = uint64(buf[0] & 0x3f)
+	for _, b := range buf[1:n] {
+		v = v<<8 | uint64(b)
+	}
+	return
+}
+
+// WriteDatagram writes payload as a DATAGRAM capsule of context 0. It does not flush.
+func WriteDatagram(w Writer, payload []byte) (err error) {
+	if len(payload) > MaxDatagramSize {
+		return ErrCapsuleTooLarge
+	}
+
+	var header [16]byte
+	b := appendVarint(header[:0], capsuleDatagram)
+	// context id 0 takes 1 byte
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = appendVarint(b, 0)
+
+	_, err = w.WriteAll(b, payload)
+	return
+}
+
+// ReadDatagram reads the payload of the next DATAGRAM capsule of context 0 into buf, which must hold
+// MaxDatagramSize bytes. Other capsules and contexts are skipped. It returns io.EOF only between capsules.
+func ReadDatagram(r Reader, buf []byte) (payload []byte, err error) {
+	for {
+		typ, _, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+
+		length, _, err := readVarint(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		if typ != capsuleDatagram {
+			if _, err = io.CopyN(io.Discard, r, int64(length)); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			continue
+		}
+
+		contextID, n, err := readVarint(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		if uint64(n) > length || length-uint64(n) > MaxDatagramSize || len(buf) < MaxDatagramSize {
+			return nil, ErrCapsuleTooLarge
+		}
+
+		payload = buf[:length-uint64(n)]
+		if _, err = r.ReadFull(payload); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		if contextID == 0 {
+			return payload, nil
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package tcp
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestVarint(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       uint64
+		encoded []byte
+	}{
+		{"1 byte", 37, []byte{0x25}},
+		{"1 byte max", 1<<6 - 1, []byte{0x3f}},
+		{"2 bytes", 15293, []byte{0x7b, 0xbd}},
+		{"4 bytes", 494878333, []byte{0x9d, 0x7f, 0x3e, 0x7d}},
+		{"8 bytes", 151288809941952652, []byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}},
+		{"8 bytes max", 1<<62 - 1, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := appendVarint(nil, test.v); !bytes.Equal(got, test.encoded) {
+				t.Fatalf("got % x, want % x", got, test.encoded)
+			}
+
+			v, n, err := readVarint(NewReader(bytes.NewReader(test.encoded), 0))
+			if err != nil || v != test.v || n != len(test.encoded) {
+				t.Fatalf("got %d of %d bytes, error %v, want %d of %d bytes", v, n, err, test.v, len(test.encoded))
+			}
+
+			// every prefix is cut short
+			for i := 1; i < len(test.encoded); i++ {
+				if _, _, err = readVarint(NewReader(bytes.NewReader(test.encoded[:i]), 0)); err != io.ErrUnexpectedEOF {
+					t.Fatalf("got error %v reading %d bytes, want %v", err, i, io.ErrUnexpectedEOF)
+				}
+			}
+		})
+	}
+
+	if _, _, err := readVarint(NewReader(bytes.NewReader(nil), 0)); err != io.EOF {
+		t.Fatalf("got error %v reading nothing, want %v", err, io.EOF)
+	}
+}
+
+// capsule returns a capsule of typ, with value prefixed by its length
+func capsule(typ uint64, value ...[]byte) []byte {
+	b := bytes.Join(value, nil)
+	return append(appendVarint(appendVarint(nil, typ), uint64(len(b))), b...)
+}
+
+func TestReadDatagram(t *testing.T) {
+	payload := []byte("datagram")
+	datagram := capsule(capsuleDatagram, []byte{0}, payload)
+	// context id 2 as a 2 byte varint
+	otherContext := capsule(capsuleDatagram, []byte{0x40, 0x02}, []byte("other"))
+
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+		err  error
+	}{
+		{"datagram", datagram, payload, nil},
+		{"empty datagram", capsule(capsuleDatagram, []byte{0}), []byte{}, nil},
+		{"no capsule", nil, nil, io.EOF},
+		{"other capsule skipped", append(capsule(0x2a, []byte("skip")), datagram...), payload, nil},
+		{"other context skipped", append(otherContext, datagram...), payload, nil},
+		{"only other capsule", capsule(0x2a, []byte("skip")), nil, io.EOF},
+		{"short type", []byte{0x40}, nil, io.ErrUnexpectedEOF},
+		{"no length", []byte{capsuleDatagram}, nil, io.ErrUnexpectedEOF},
+		{"short length", []byte{capsuleDatagram, 0x80, 0x00}, nil, io.ErrUnexpectedEOF},
+		{"no context id", []byte{capsuleDatagram, 0x05}, nil, io.ErrUnexpectedEOF},
+		{"length past end", datagram[:len(datagram)-1], nil, io.ErrUnexpectedEOF},
+		{"other capsule past end", capsule(0x2a, []byte("skip"))[:4], nil, io.ErrUnexpectedEOF},
+		{"length short of context id", []byte{capsuleDatagram, 0x01, 0x40, 0x02}, nil, ErrCapsuleTooLarge},
+		{"too large", append([]byte{capsuleDatagram}, append(appendVarint([]byte{}, MaxDatagramSize+2), 0)...), nil, ErrCapsuleTooLarge},
+		{"8 byte length", []byte{capsuleDatagram, 0xc0, 0, 0, 0, 0, 0, 0, 0x09, 0}, nil, io.ErrUnexpectedEOF},
+		{"8 byte length too large", []byte{capsuleDatagram, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0}, nil, ErrCapsuleTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := make([]byte, MaxDatagramSize)
+			got, err := ReadDatagram(NewReader(bytes.NewReader(test.in), 4096), buf)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+
+			if err == nil && !bytes.Equal(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWriteDatagram(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		err     error
+	}{
+		{"empty", []byte{}, nil},
+		{"small", []byte("datagram"), nil},
+		// the length takes 2 bytes from 63 bytes on, including the context id
+		{"2 byte length", bytes.Repeat([]byte{1}, 63), nil},
+		{"4 byte length", bytes.Repeat([]byte{1}, 1<<14), nil},
+		{"max", bytes.Repeat([]byte{1}, MaxDatagramSize), nil},
+		{"too large", make([]byte, MaxDatagramSize+1), ErrCapsuleTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var out bytes.Buffer
+			w := NewWriter(&out, 4096)
+			if err := WriteDatagram(w, test.payload); err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+
+			if err := w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.err != nil {
+				if out.Len() > 0 {
+					t.Fatalf("got %d bytes written on error", out.Len())
+				}
+				return
+			}
+
+			buf := make([]byte, MaxDatagramSize)
+			got, err := ReadDatagram(NewReader(&out, 4096), buf)
+			if err != nil || !bytes.Equal(got, test.payload) {
+				t.Fatalf("got %d bytes back, error %v, want %d bytes", len(got), err, len(test.payload))
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/lib"
+)
+
+var ErrNoCertificates = errors.New("No certificates found in CA file")
+var ErrNoClientCA = errors.New("A CA file is required to verify clients")
+
+// certificate is the key pair presented, with the OCSP staple if any
+type certificate struct {
+	tls.Certificate
+	// unstapled is presented once the staple is past stapleExpires, as strict clients reject a stale one
+	unstapled     tls.Certificate
+	stapleExpires time.Time
+}
+
+// CertStore holds a key pair and a CA bundle loaded from files. Reload replaces them
+// for new handshakes, while existing connections keep running.
+type CertStore struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	ocspFile string
+	mu       sync.Mutex
+	watcher  *lib.FileWatcher
+	cert     atomic.Pointer[certificate]
+	pool     atomic.Pointer[x509.CertPool]
+	base     *tls.Config
+	server   atomic.Pointer[tls.Config]
+}
+
+// NewCertStore loads the key pair, and the CA bundle if caFile is not empty
+func NewCertStore(certFile string, keyFile string, caFile string) (*CertStore, error) {
+	ret := &CertStore{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		watcher:  lib.NewFileWatcher(certFile, keyFile, caFile),
+	}
+
+	if err := ret.Reload(); err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// SetOCSPStaple staples the DER encoded OCSP response in file to the certificate, and reloads it with the certificate
+func (self *CertStore) SetOCSPStaple(file string) error {
+	self.mu.Lock()
+	self.ocspFile = file
+	self.mu.Unlock()
+
+	self.watcher.Add(file)
+	return self.Reload()
+}
+
+// Reload reads all files again. On error, the material loaded before is kept.
+func (self *CertStore) Reload() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	// a bad file is reported once, rather than on every poll
+	self.watcher.Mark()
+
+	var err error
+	var cert certificate
+	if cert.Certificate, err = tls.LoadX509KeyPair(self.certFile, self.keyFile); err != nil {
+		return err
+	}
+
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	cert.unstapled = cert.Certificate
+
+	if self.ocspFile != "" {
+		if cert.OCSPStaple, err = os.ReadFile(self.ocspFile); err != nil {
+			return err
+		}
+
+		var issuer *x509.Certificate
+		if len(cert.Certificate.Certificate) > 1 {
+			if issuer, err = x509.ParseCertificate(cert.Certificate.Certificate[1]); err != nil {
+				return err
+			}
+		}
+
+		// a stale or mismatched staple would get the handshake rejected by clients checking it
+		if cert.stapleExpires, err = CheckOCSPStaple(cert.OCSPStaple, cert.Leaf, issuer, time.Now()); err != nil {
+			return fmt.Errorf("%s: %w", self.ocspFile, err)
+		}
+	}
+
+	var pool *x509.CertPool
+	if self.caFile != "" {
+		pem, err := os.ReadFile(self.caFile)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrNoCertificates
+		}
+	}
+
+	if self.base != nil && pool == nil {
+		// a nil ClientCAs verifies clients against the system roots
+		return ErrNoClientCA
+	}
+
+	self.cert.Store(&cert)
+	self.pool.Store(pool)
+
+	if self.base != nil {
+		self.server.Store(self.serverConfig())
+	}
+
+	return nil
+}
+
+// Watch polls files every interval until ctx is done, and reloads them on change.
+// onReload is called with the result of each reload.
+func (self *CertStore) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	self.watcher.Watch(ctx, interval, func() {
+		onReload(self.Reload())
+	})
+}
+
+// Leaf returns the current certificate
+func (self *CertStore) Leaf() *x509.Certificate {
+	return self.cert.Load().Leaf
+}
+
+// CertPool returns the current CA bundle, or nil if there is no CA file
+func (self *CertStore) CertPool() *x509.CertPool {
+	return self.pool.Load()
+}
+
+// GetCertificate returns the current certificate, stapled unless the staple has expired since loaded
+func (self *CertStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := self.cert.Load()
+	if !cert.stapleExpires.IsZero() && !time.Now().Before(cert.stapleExpires) {
+		return &cert.unstapled, nil
+	}
+	return &cert.Certificate, nil
+}
+
+func (self *CertStore) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return &self.cert.Load().Certificate, nil
+}
+
+func (self *CertStore) serverConfig() *tls.Config {
+	ret := self.base.Clone()
+	ret.GetConfigForClient = nil
+	ret.GetCertificate = self.GetCertificate
+	ret.ClientCAs = self.pool.Load()
+	return ret
+}
+
+// ServerConfig returns a server side config based on base, which presents the current certificate,
+// and verifies clients with the current CA bundle. It fails if there is no CA file, as clients would
+// otherwise be verified against the system roots.
+func (self *CertStore) ServerConfig(base *tls.Config) (*tls.Config, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.pool.Load() == nil {
+		return nil, ErrNoClientCA
+	}
+
+	self.base = base.Clone()
+	self.server.Store(self.serverConfig())
+
+	ret := base.Clone()
+	ret.GetCertificate = self.GetCertificate
+	ret.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return self.server.Load(), nil
+	}
+	return ret, nil
+}
+
+// ClientConfig returns a client side config based on base, which presents the current certificate,
+// and verifies the server with the current CA bundle. Call it per dial to pick up reloads.
+func (self *CertStore) ClientConfig(base *tls.Config) *tls.Config {
+	ret := base.Clone()
+	ret.GetClientCertificate = self.GetClientCertificate
+	if pool := self.pool.Load(); pool != nil {
+		ret.RootCAs = pool
+	}
+	return ret
+}
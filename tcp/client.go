@@ -1,11 +1,30 @@
 package tcp
 
 import (
+	"context"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// DialerHooks are called on dial events, e.g. to collect metrics. They must not block.
+type DialerHooks struct {
+	// Dialed is called when a dial completes, with the time it took and the error if failed
+	Dialed func(address string, elapsed time.Duration, err error)
+}
+
 type TcpDialer struct {
-	Dialer        *net.Dialer
+	Dialer *net.Dialer
+	// Resolver resolves host names to dial. Nil to use the system resolver.
+	Resolver *Resolver
+	// Inspect checks the IPs of every dial, ahead of the InspectFunc given to DialInspect. Nil to allow all.
+	Inspect InspectFunc
+	// Family picks the IPs dialed of destinations resolving to both IPv4 and IPv6
+	Family AddressFamily
+	// FallbackDelay is the head start of each IP of a destination over the next. 0 to dial them one after another.
+	FallbackDelay time.Duration
+	Hooks         DialerHooks
 	tcpNoDelay    bool
 	readerBufSize int
 	writerBufSize int
@@ -20,8 +39,98 @@ func NewDialer(tcpNoDelay bool, readerBufSize, writerBufSize int) *TcpDialer {
 	}
 }
 
+// Resolve resolves the host of address, and returns the ip:port addresses passing inspect of the family dialed,
+// in the order to dial. IPs are never resolved again once inspected, so a name rebound in between does not bypass
+// inspect. If there is nothing to inspect or pick and no Resolver, address is returned as is, left to Dialer.
+func (self *TcpDialer) Resolve(ctx context.Context, address string, inspect InspectFunc) ([]string, error) {
+	if self.Resolver == nil && self.Inspect == nil && inspect == nil && self.Family == FamilyDual && self.Dialer.LocalAddr == nil {
+		return []string{address}, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, &net.AddrError{Err: "invalid port", Addr: address}
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var ips []net.IP
+	switch ip := net.ParseIP(host); {
+	case ip != nil:
+		ips = []net.IP{ip}
+	case self.Resolver != nil:
+		ips, err = self.Resolver.LookupIP(ctx, host)
+	default:
+		ips, err = systemResolver(self.Dialer).LookupIP(ctx, "ip", host)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fn := range []InspectFunc{self.Inspect, inspect} {
+		if fn == nil {
+			continue
+		}
+
+		if ips, err = fn(host, port, ips); err != nil {
+			return nil, err
+		}
+	}
+
+	if ips, err = self.sortByFamily(host, ips); err != nil {
+		return nil, err
+	}
+
+	ret := make([]string, len(ips))
+	for i, ip := range ips {
+		ret[i] = net.JoinHostPort(ip.String(), portStr)
+	}
+
+	return ret, nil
+}
+
+// DialUdp returns a UDP socket connected to the first of addresses it can, e.g. returned by Resolve, with
+// the source address and socket options of Dialer
+func (self *TcpDialer) DialUdp(addresses []string) (conn *net.UDPConn, err error) {
+	if len(addresses) == 0 {
+		return nil, ErrNoAddress
+	}
+
+	dialer := dialerFor(self.Dialer, "udp")
+	for _, addr := range addresses {
+		var c net.Conn
+		if c, err = dialer.Dial("udp", addr); err == nil {
+			return c.(*net.UDPConn), nil
+		}
+	}
+	return
+}
+
 func (self *TcpDialer) Dial(address string) (*TcpConn, error) {
-	conn, err := self.Dialer.Dial("tcp", address)
+	return self.DialInspect(address, nil)
+}
+
+// DialInspect dials address like Dial, with the IPs it resolves to checked by inspect as well as Inspect.
+// The IPs are dialed in turn, racing each other by FallbackDelay, and the first connection made is returned.
+func (self *TcpDialer) DialInspect(address string, inspect InspectFunc) (*TcpConn, error) {
+	start := time.Now()
+
+	var conn net.Conn
+	addresses, err := self.Resolve(context.Background(), address, inspect)
+	if err == nil {
+		conn, err = self.dialAddresses(addresses)
+	}
+
+	if self.Hooks.Dialed != nil {
+		self.Hooks.Dialed(address, time.Since(start), err)
+	}
+
 	if err != nil {
 		return nil, err
 	}
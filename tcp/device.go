@@ -0,0 +1,5 @@
+package tcp
+
+import "errors"
+
+var ErrBindToDeviceUnsupported = errors.New("Binding to a network interface is only supported on linux")
@@ -0,0 +1,21 @@
+//go:build linux
+
+package tcp
+
+import "syscall"
+
+// BindToDeviceControl returns a net.Dialer Control binding sockets to network interface device with
+// SO_BINDTODEVICE, so that they go out of it whatever the routing table says. Requires CAP_NET_RAW.
+func BindToDeviceControl(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		controlErr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+		})
+
+		if controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tcp
+
+import "syscall"
+
+func BindToDeviceControl(device string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return ErrBindToDeviceUnsupported
+	}
+}
@@ -0,0 +1,170 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var ErrNoAddress = errors.New("No address to dial")
+
+// AddressFamily picks the IPs TcpDialer dials of a destination
+type AddressFamily int
+
+const (
+	// FamilyDual dials IPs of both families, interleaved starting with the family of the first IP resolved
+	FamilyDual AddressFamily = iota
+	FamilyIPv4
+	FamilyIPv6
+	// FamilyPreferIPv6 dials IPs of both families, interleaved starting with IPv6 (RFC 8305 section 4)
+	FamilyPreferIPv6
+)
+
+// ParseAddressFamily parses dual, ipv4, ipv6 or prefer-ipv6
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch s {
+	case "dual", "":
+		return FamilyDual, nil
+	case "ipv4":
+		return FamilyIPv4, nil
+	case "ipv6":
+		return FamilyIPv6, nil
+	case "prefer-ipv6":
+		return FamilyPreferIPv6, nil
+	}
+	return 0, fmt.Errorf("Unknown address family %s, expecting dual, ipv4, ipv6 or prefer-ipv6", s)
+}
+
+// sortByFamily drops IPs of family not dialed, or not matching the family of the source address if any, and
+// interleaves the rest by family
+func (self *TcpDialer) sortByFamily(host string, ips []net.IP) ([]net.IP, error) {
+	family := self.Family
+	if local, ok := self.Dialer.LocalAddr.(*net.TCPAddr); ok && local != nil && local.IP != nil && !local.IP.IsUnspecified() {
+		// a source address only reaches destinations of its own family
+		family = FamilyIPv6
+		if local.IP.To4() != nil {
+			family = FamilyIPv4
+		}
+	}
+
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	first, second := v4, v6
+	switch family {
+	case FamilyIPv4:
+		second = nil
+	case FamilyIPv6:
+		first, second = v6, nil
+	case FamilyPreferIPv6:
+		first, second = v6, v4
+	default:
+		if len(ips) > 0 && ips[0].To4() == nil {
+			first, second = v6, v4
+		}
+	}
+
+	if len(first)+len(second) == 0 {
+		return nil, &net.DNSError{Err: "no address of the family dialed", Name: host, IsNotFound: true}
+	}
+
+	ret := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ret = append(ret, first[i])
+		}
+		if i < len(second) {
+			ret = append(ret, second[i])
+		}
+	}
+
+	return ret, nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialAddresses dials addresses in turn, each FallbackDelay after the previous one unless it failed earlier, and
+// returns the first connection made, closing the others (Happy Eyeballs, RFC 8305 section 5)
+func (self *TcpDialer) dialAddresses(addresses []string) (net.Conn, error) {
+	if len(addresses) == 0 {
+		return nil, ErrNoAddress
+	}
+
+	if self.FallbackDelay <= 0 || len(addresses) == 1 {
+		var err error
+		for _, addr := range addresses {
+			var conn net.Conn
+			if conn, err = self.Dialer.Dial("tcp", addr); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	results := make(chan dialResult, len(addresses))
+	next, pending := 0, 0
+	var delay <-chan time.Time
+
+	attempt := func() {
+		go func(addr string) {
+			conn, err := self.Dialer.DialContext(ctx, "tcp", addr)
+			results <- dialResult{conn, err}
+		}(addresses[next])
+
+		next++
+		pending++
+		if next < len(addresses) {
+			delay = time.After(self.FallbackDelay)
+		}
+	}
+
+	attempt()
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(pending int) {
+					// attempts still in flight are cancelled, and closed if they made it anyway
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = r.err
+			}
+
+			// a failed attempt hands over to the next one without waiting
+			if next < len(addresses) {
+				attempt()
+			}
+		case <-delay:
+			if next < len(addresses) {
+				attempt()
+			}
+		}
+	}
+
+	return nil, firstErr
+}
@@ -2,8 +2,12 @@ package tcp
 
 import (
 	"errors"
+	"net/http"
+	"net/textproto"
 	"strconv"
 	"strings"
+
+	"github.com/z-george-ma/buggy/v2/lib"
 )
 
 type HttpRequest struct {
@@ -17,13 +21,17 @@ type HttpResponse struct {
 	StatusCode int
 	Reason     string
 	Version    string
-	Headers    map[string]string
+	// Headers are keyed by lower case name. Repeated Set-Cookie headers are kept as lines of one value.
+	Headers map[string]string
 }
 
 var MaxHeadersSupported = 100
 var ErrHttpMalformedHeader = errors.New("Malformed HTTP Header")
 var ErrExceedingHeaderCount = errors.New("Exceeding max number of HTTP headers")
 
+var crlf = []byte("\r\n")
+var space = []byte(" ")
+
 func parseHttp(r Reader, parseStartLine func(string) error) (headers map[string]string, err error) {
 	var buf, b []byte
 
@@ -38,7 +46,7 @@ func parseHttp(r Reader, parseStartLine func(string) error) (headers map[string]
 
 		l := len(b)
 
-		if b[l-2] != '\r' {
+		if l < 2 || b[l-2] != '\r' {
 			err = ErrHttpMalformedHeader
 			return
 		}
@@ -61,12 +69,25 @@ func parseHttp(r Reader, parseStartLine func(string) error) (headers map[string]
 			break
 		}
 
-		s := strings.Split(bs, ": ")
-		if len(s) != 2 {
+		name, value, ok := strings.Cut(bs, ":")
+		if !ok || len(name) == 0 {
 			err = ErrHttpMalformedHeader
 			return
 		}
-		headers[strings.ToLower(s[0])] = s[1]
+
+		name = strings.ToLower(name)
+		value = strings.TrimSpace(value)
+
+		if v, ok := headers[name]; ok {
+			if name == "set-cookie" {
+				// cookies may contain commas and cannot be folded (RFC 6265 section 3), keep one per line
+				value = v + "\n" + value
+			} else {
+				// fold repeated headers into a single comma separated list
+				value = v + ", " + value
+			}
+		}
+		headers[name] = value
 
 		if len(headers) > MaxHeadersSupported {
 			err = ErrExceedingHeaderCount
@@ -102,13 +123,15 @@ func ParseHttpResponse(r Reader) (ret HttpResponse, err error) {
 	ret = HttpResponse{}
 
 	ret.Headers, err = parseHttp(r, func(s string) error {
-		ss := strings.Split(s, " ")
-		if len(ss) != 3 {
+		ss := strings.SplitN(s, " ", 3)
+		if len(ss) < 2 {
 			return ErrHttpMalformedHeader
 		}
 
 		ret.Version = ss[0]
-		ret.Reason = ss[2]
+		if len(ss) == 3 {
+			ret.Reason = ss[2]
+		}
 
 		if len(ss[1]) != 3 || !strings.HasPrefix(ret.Version, "HTTP/") {
 			return ErrHttpMalformedHeader
@@ -120,3 +143,77 @@ func ParseHttpResponse(r Reader) (ret HttpResponse, err error) {
 
 	return
 }
+
+// writeHeaders writes headers, with each line of a multi-line value, i.e. repeated Set-Cookie, as a header of its own
+func writeHeaders(w Writer, headers map[string]string) (err error) {
+	for k, v := range headers {
+		name := lib.StringToBytes(textproto.CanonicalMIMEHeaderKey(k))
+		for _, line := range strings.Split(v, "\n") {
+			if _, err = w.WriteAll(name, []byte(": "), lib.StringToBytes(line), crlf); err != nil {
+				return
+			}
+		}
+	}
+
+	_, err = w.Write(crlf)
+	return
+}
+
+// WriteHttpRequest writes request line and headers. It does not flush the writer.
+func WriteHttpRequest(w Writer, req *HttpRequest) (err error) {
+	version := req.Version
+	if version == "" {
+		version = "HTTP/1.1"
+	}
+
+	if _, err = w.WriteAll(lib.StringToBytes(req.Method), space, lib.StringToBytes(req.Url), space, lib.StringToBytes(version), crlf); err != nil {
+		return
+	}
+
+	return writeHeaders(w, req.Headers)
+}
+
+// WriteHttpResponse writes status line and headers. It does not flush the writer.
+func WriteHttpResponse(w Writer, resp *HttpResponse) (err error) {
+	version := resp.Version
+	if version == "" {
+		version = "HTTP/1.1"
+	}
+
+	if _, err = w.WriteAll(lib.StringToBytes(version), space, strconv.AppendInt(nil, int64(resp.StatusCode), 10), space, lib.StringToBytes(resp.Reason), crlf); err != nil {
+		return
+	}
+
+	return writeHeaders(w, resp.Headers)
+}
+
+// WriteHttpStatus writes a complete response with a short text body and flushes the writer.
+// The connection is marked to be closed after the response.
+func WriteHttpStatus(w Writer, statusCode int, headers map[string]string, body string) (err error) {
+	if headers == nil {
+		headers = map[string]string{}
+	}
+
+	headers["connection"] = "close"
+	headers["content-length"] = strconv.Itoa(len(body))
+	if len(body) > 0 {
+		headers["content-type"] = "text/plain; charset=utf-8"
+	}
+
+	response := HttpResponse{
+		StatusCode: statusCode,
+		Reason:     http.StatusText(statusCode),
+		Version:    "HTTP/1.1",
+		Headers:    headers,
+	}
+
+	if err = WriteHttpResponse(w, &response); err != nil {
+		return
+	}
+
+	if _, err = w.Write(lib.StringToBytes(body)); err != nil {
+		return
+	}
+
+	return w.Flush()
+}
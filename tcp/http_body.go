@@ -0,0 +1,129 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var ErrHttpMalformedChunk = errors.New("Malformed HTTP chunk")
+var ErrHttpInvalidContentLength = errors.New("Invalid HTTP Content-Length")
+var ErrHttpUnsupportedTransferEncoding = errors.New("Unsupported HTTP Transfer-Encoding")
+
+// writerOnly hides io.ReaderFrom of the underlying connection, so that io.Copy
+// goes through the buffered writer and keeps ordering with bytes already buffered.
+type writerOnly struct {
+	io.Writer
+}
+
+// HttpBodyLength returns the framing of a message body as declared by headers.
+// chunked is true for chunked transfer encoding. Otherwise length is the value
+// of Content-Length, or -1 if the message does not declare it.
+func HttpBodyLength(headers map[string]string) (length int64, chunked bool, err error) {
+	if te, ok := headers["transfer-encoding"]; ok {
+		encodings := strings.Split(te, ",")
+
+		// chunked must be the final encoding
+		if !strings.EqualFold(strings.TrimSpace(encodings[len(encodings)-1]), "chunked") {
+			return -1, false, ErrHttpUnsupportedTransferEncoding
+		}
+
+		return -1, true, nil
+	}
+
+	cl, ok := headers["content-length"]
+	if !ok {
+		return -1, false, nil
+	}
+
+	// repeated Content-Length headers are folded by parseHttp, and must all agree
+	for i, v := range strings.Split(cl, ",") {
+		n, e := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if e != nil || n < 0 || (i > 0 && n != length) {
+			return 0, false, ErrHttpInvalidContentLength
+		}
+		length = n
+	}
+
+	return
+}
+
+// CopyHttpBody copies a message body from src to dst, preserving its framing.
+// length < 0 and !chunked copies until src reaches EOF.
+func CopyHttpBody(dst Writer, src Reader, length int64, chunked bool) (n int64, err error) {
+	if chunked {
+		return copyChunked(dst, src)
+	}
+
+	if length >= 0 {
+		return io.CopyN(writerOnly{dst}, src, length)
+	}
+
+	return io.Copy(writerOnly{dst}, src)
+}
+
+func copyChunked(dst Writer, src Reader) (n int64, err error) {
+	var buf, b []byte
+	var written int
+	var copied int64
+
+	for {
+		b, err = src.ReadSlice('\n', &buf)
+		if err != nil {
+			return
+		}
+
+		l := len(b)
+		if l < 2 || b[l-2] != '\r' {
+			err = ErrHttpMalformedChunk
+			return
+		}
+
+		sizeStr, _, _ := strings.Cut(string(b[:l-2]), ";")
+		size, e := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if e != nil || size < 0 {
+			err = ErrHttpMalformedChunk
+			return
+		}
+
+		written, err = dst.Write(b)
+		n += int64(written)
+		if err != nil {
+			return
+		}
+
+		if size == 0 {
+			break
+		}
+
+		// chunk data followed by CRLF
+		copied, err = io.CopyN(writerOnly{dst}, src, size+2)
+		n += copied
+		if err != nil {
+			return
+		}
+
+		if err = dst.Flush(); err != nil {
+			return
+		}
+	}
+
+	// trailer section ends with an empty line
+	for {
+		b, err = src.ReadSlice('\n', &buf)
+		if err != nil {
+			return
+		}
+
+		written, err = dst.Write(b)
+		n += int64(written)
+		if err != nil {
+			return
+		}
+
+		if len(b) == 2 && b[0] == '\r' {
+			return n, dst.Flush()
+		}
+	}
+}
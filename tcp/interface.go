@@ -2,6 +2,7 @@ package tcp
 
 import (
 	"io"
+	"time"
 )
 
 type Reader interface {
@@ -54,20 +55,70 @@ func Copy(d io.ReaderFrom, s io.Reader, result chan CopyResult) {
 	}
 }
 
+// SpliceStats summarises a splice
+type SpliceStats struct {
+	// bytes copied from src to dst
+	SrcToDst int64
+	// bytes copied from dst to src
+	DstToSrc int64
+	Duration time.Duration
+	// SrcClosedFirst is true if the copy from src to dst ended first
+	SrcClosedFirst bool
+	SrcToDstErr    error
+	DstToSrcErr    error
+}
+
+func (self *SpliceStats) add(result CopyResult, dst Conn) {
+	if result.Dst == dst {
+		self.SrcToDst, self.SrcToDstErr = result.Len, result.Err
+	} else {
+		self.DstToSrc, self.DstToSrcErr = result.Len, result.Err
+	}
+}
+
 func Splice(dst Conn, src Conn) error {
+	_, err := SpliceWithOptions(dst, src, SpliceOptions{})
+	return err
+}
+
+// SpliceWithOptions copies data in both directions until both sides are closed.
+// If copy fails in either direction, both connections are reset.
+// If a timeout in options fires, both connections are reset and the timeout error is returned.
+func SpliceWithOptions(dst Conn, src Conn, options SpliceOptions) (stats SpliceStats, err error) {
+	start := time.Now()
+	srcReader, dstReader := src.RawReader(), dst.RawReader()
+
+	var watchdog *spliceWatchdog
+	if options.IdleTimeout > 0 || options.MaxLifetime > 0 {
+		watchdog = newSpliceWatchdog(dst, src, options)
+		defer watchdog.stop()
+
+		srcReader, dstReader = watchdog.reader(srcReader), watchdog.reader(dstReader)
+	}
+
 	ret := make(chan CopyResult, 2)
-	go Copy(dst, src.RawReader(), ret)
-	go Copy(src, dst.RawReader(), ret)
+	go Copy(dst, srcReader, ret)
+	go Copy(src, dstReader, ret)
 
 	result := <-ret
 	result.Dst.(Conn).CloseWrite()
+	stats.add(result, dst)
+	stats.SrcClosedFirst = result.Dst == dst
+	err = result.Err
 
-	if result.Err != nil {
-		return result.Err
+	if err != nil {
+		dst.Reset()
+		src.Reset()
 	}
 
 	result = <-ret
 	result.Dst.(Conn).CloseWrite()
+	stats.add(result, dst)
+	stats.Duration = time.Since(start)
+
+	if err == nil {
+		err = result.Err
+	}
 
-	return result.Err
+	return stats, watchdog.result(err)
 }
@@ -40,14 +40,15 @@ func (self *ReaderImpl) Read(p []byte) (n int, err error) {
 	if n > 0 {
 		buf := *self.snapshot
 		l := len(buf)
-		bytesToAppend := l + n - self.maxSnapshotBufSize
+		overflow := l + n - self.maxSnapshotBufSize
 
-		if bytesToAppend <= 0 {
+		if overflow <= 0 {
 			*self.snapshot = append(buf, p[:n]...)
 			return
 		}
 
-		*self.snapshot = append(buf, p[:bytesToAppend]...)
+		// keep what fits in the snapshot
+		*self.snapshot = append(buf, p[:n-overflow]...)
 		err = bufio.ErrBufferFull
 	}
 	return
@@ -178,10 +179,22 @@ func (self *ReaderImpl) GetSnapshot(clearSnapshot bool) (ret []byte) {
 	return ret
 }
 
+// Unread returns a reader over rd that yields bytes already buffered by the reader first.
+// It allows the caller to bypass the reader without losing data.
+func (self *ReaderImpl) Unread(rd io.Reader) io.Reader {
+	if self.buf == nil || self.buf.Buffered() == 0 {
+		return rd
+	}
+
+	return io.MultiReader(io.LimitReader(self.buf, int64(self.buf.Buffered())), rd)
+}
+
 func (self *ReaderImpl) Reset(rd io.Reader) {
-	self.reader = rd
+	self.rawReader = rd
 	if self.buf != nil {
 		self.buf.Reset(rd)
+	} else {
+		self.reader = rd
 	}
 }
 
@@ -0,0 +1,559 @@
+package tcp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MuxProtocol is the ALPN protocol id of multiplexed sessions
+const MuxProtocol = "buggy-mux/1"
+
+// Frame layout: type(1) flags(1) stream id(4) payload length(4) payload
+const (
+	muxFrameData byte = iota
+	muxFrameOpen
+	muxFrameClose
+	muxFrameReset
+	muxFrameWindow
+	muxFramePing
+	muxFrameGoAway
+)
+
+const (
+	muxFlagAck       byte = 1
+	muxHeaderSize         = 10
+	muxMaxFrameSize       = 16384
+	muxInitialWindow      = 256 * 1024
+	muxAcceptBacklog      = 128
+)
+
+var ErrMuxSessionClosed = errors.New("Mux session closed")
+var ErrMuxStreamReset = errors.New("Mux stream reset by peer")
+var ErrMuxStreamClosed = errors.New("Mux stream closed")
+var ErrMuxProtocol = errors.New("Mux protocol error")
+var ErrMuxKeepAliveTimeout = errors.New("Mux keepalive timeout")
+var ErrMuxGoingAway = errors.New("Mux session going away")
+
+// MuxSession carries many logical streams over a single connection.
+// Client side streams have odd ids and server side streams have even ids.
+type MuxSession struct {
+	conn          Conn
+	readerBufSize int
+	writerBufSize int
+	writeMu       sync.Mutex
+	mu            sync.Mutex
+	streams       map[uint32]*MuxStream
+	nextID        uint32
+	accept        chan *MuxConn
+	closed        chan struct{}
+	closeOnce     sync.Once
+	err           error
+	lastRecv      atomic.Int64
+	// goAway is closed when this side stops accepting streams
+	goAway     chan struct{}
+	goAwayOnce sync.Once
+	// remoteGoAway is set when the peer stops accepting streams
+	remoteGoAway atomic.Bool
+}
+
+// NewMuxSession starts a session over conn.
+// keepAlive: interval of pings. The session is closed if nothing is received for 3 intervals. 0 to disable.
+func NewMuxSession(conn Conn, client bool, keepAlive time.Duration, readerBufSize, writerBufSize int) *MuxSession {
+	ret := &MuxSession{
+		conn:          conn,
+		readerBufSize: readerBufSize,
+		writerBufSize: writerBufSize,
+		streams:       map[uint32]*MuxStream{},
+		nextID:        2,
+		accept:        make(chan *MuxConn, muxAcceptBacklog),
+		closed:        make(chan struct{}),
+		goAway:        make(chan struct{}),
+	}
+
+	if client {
+		ret.nextID = 1
+	}
+
+	ret.lastRecv.Store(time.Now().UnixNano())
+
+	go ret.readLoop()
+	if keepAlive > 0 {
+		go ret.keepAliveLoop(keepAlive)
+	}
+
+	return ret
+}
+
+func (self *MuxSession) writeFrame(typ byte, flags byte, id uint32, payload []byte) (err error) {
+	var header [muxHeaderSize]byte
+	header[0] = typ
+	header[1] = flags
+	binary.BigEndian.PutUint32(header[2:], id)
+	binary.BigEndian.PutUint32(header[6:], uint32(len(payload)))
+
+	self.writeMu.Lock()
+	defer self.writeMu.Unlock()
+
+	select {
+	case <-self.closed:
+		return ErrMuxSessionClosed
+	default:
+	}
+
+	if _, err = self.conn.WriteAll(header[:], payload); err == nil {
+		err = self.conn.Flush()
+	}
+
+	if err != nil {
+		go self.closeWithError(err)
+	}
+	return
+}
+
+func (self *MuxSession) closeWithError(err error) {
+	self.closeOnce.Do(func() {
+		self.err = err
+		close(self.closed)
+		self.conn.Close()
+
+		self.mu.Lock()
+		streams := self.streams
+		self.streams = map[uint32]*MuxStream{}
+		self.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.fail(err)
+		}
+	})
+}
+
+func (self *MuxSession) newStream(id uint32) *MuxConn {
+	stream := &MuxStream{
+		id:            id,
+		session:       self,
+		recvAvailable: muxInitialWindow,
+		sendWindow:    muxInitialWindow,
+	}
+	stream.cond = sync.NewCond(&stream.mu)
+	self.streams[id] = stream
+
+	return &MuxConn{
+		Reader: NewReader(stream, self.readerBufSize),
+		Writer: NewWriter(stream, self.writerBufSize),
+		stream: stream,
+	}
+}
+
+func (self *MuxSession) remove(id uint32) {
+	self.mu.Lock()
+	delete(self.streams, id)
+	self.mu.Unlock()
+}
+
+func (self *MuxSession) readLoop() {
+	var header [muxHeaderSize]byte
+
+	for {
+		if _, err := self.conn.ReadFull(header[:]); err != nil {
+			self.closeWithError(err)
+			return
+		}
+
+		self.lastRecv.Store(time.Now().UnixNano())
+
+		typ, flags := header[0], header[1]
+		id := binary.BigEndian.Uint32(header[2:])
+		length := binary.BigEndian.Uint32(header[6:])
+
+		if length > muxMaxFrameSize {
+			self.closeWithError(ErrMuxProtocol)
+			return
+		}
+
+		var payload []byte
+		if length > 0 {
+			payload = make([]byte, length)
+			if _, err := self.conn.ReadFull(payload); err != nil {
+				self.closeWithError(err)
+				return
+			}
+		}
+
+		switch typ {
+		case muxFramePing:
+			if flags&muxFlagAck == 0 {
+				go self.writeFrame(muxFramePing, muxFlagAck, 0, payload)
+			}
+			continue
+		case muxFrameGoAway:
+			// streams in flight carry on, until the peer closes the session
+			self.remoteGoAway.Store(true)
+			continue
+		case muxFrameOpen:
+			self.mu.Lock()
+			_, exists := self.streams[id]
+			if exists || id%2 == self.nextID%2 {
+				self.mu.Unlock()
+				self.closeWithError(ErrMuxProtocol)
+				return
+			}
+			conn := self.newStream(id)
+			self.mu.Unlock()
+
+			select {
+			case <-self.goAway:
+				// raced with GoAway
+				conn.Reset()
+				continue
+			default:
+			}
+
+			select {
+			case self.accept <- conn:
+			default:
+				// accept backlog is full
+				conn.Reset()
+			}
+			continue
+		}
+
+		self.mu.Lock()
+		stream := self.streams[id]
+		self.mu.Unlock()
+
+		if stream == nil {
+			if typ != muxFrameReset {
+				go self.writeFrame(muxFrameReset, 0, id, nil)
+			}
+			continue
+		}
+
+		stream.receive(typ, payload)
+	}
+}
+
+func (self *MuxSession) keepAliveLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var payload [8]byte
+	for {
+		select {
+		case <-self.closed:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, self.lastRecv.Load())) > 3*interval {
+				self.closeWithError(ErrMuxKeepAliveTimeout)
+				return
+			}
+
+			binary.BigEndian.PutUint64(payload[:], uint64(now.UnixNano()))
+			self.writeFrame(muxFramePing, 0, 0, payload[:])
+		}
+	}
+}
+
+// Open starts a new stream
+func (self *MuxSession) Open() (*MuxConn, error) {
+	if self.remoteGoAway.Load() {
+		return nil, ErrMuxGoingAway
+	}
+
+	self.mu.Lock()
+	select {
+	case <-self.closed:
+		self.mu.Unlock()
+		return nil, ErrMuxSessionClosed
+	default:
+	}
+
+	id := self.nextID
+	self.nextID += 2
+	conn := self.newStream(id)
+	self.mu.Unlock()
+
+	if err := self.writeFrame(muxFrameOpen, 0, id, nil); err != nil {
+		self.remove(id)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Accept waits for a stream opened by the peer. It fails with ErrMuxGoingAway after GoAway.
+func (self *MuxSession) Accept() (*MuxConn, error) {
+	select {
+	case conn := <-self.accept:
+		return conn, nil
+	default:
+	}
+
+	select {
+	case conn := <-self.accept:
+		return conn, nil
+	case <-self.closed:
+		return nil, self.err
+	case <-self.goAway:
+		return nil, ErrMuxGoingAway
+	}
+}
+
+// GoAway tells the peer to open no more streams, while streams in flight carry on
+func (self *MuxSession) GoAway() error {
+	self.goAwayOnce.Do(func() {
+		close(self.goAway)
+	})
+	return self.writeFrame(muxFrameGoAway, 0, 0, nil)
+}
+
+// Done is closed when the session ends
+func (self *MuxSession) Done() <-chan struct{} {
+	return self.closed
+}
+
+func (self *MuxSession) NumStreams() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return len(self.streams)
+}
+
+// Close tells the peer the session is going away, and closes all streams
+func (self *MuxSession) Close() error {
+	self.writeFrame(muxFrameGoAway, 0, 0, nil)
+	self.closeWithError(ErrMuxSessionClosed)
+	return nil
+}
+
+// MuxStream is the raw byte stream of a logical connection with per stream flow control.
+type MuxStream struct {
+	id      uint32
+	session *MuxSession
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	// bytes read but not yet returned to the peer as window
+	recvConsumed int
+	// bytes the peer is still allowed to send
+	recvAvailable int
+	sendWindow    int
+	remoteClosed  bool
+	localClosed   bool
+	readClosed    bool
+	err           error
+}
+
+func (self *MuxStream) fail(err error) {
+	self.mu.Lock()
+	if self.err == nil {
+		self.err = err
+	}
+	self.mu.Unlock()
+	self.cond.Broadcast()
+}
+
+func (self *MuxStream) receive(typ byte, payload []byte) {
+	self.mu.Lock()
+
+	switch typ {
+	case muxFrameData:
+		if len(payload) > self.recvAvailable {
+			self.mu.Unlock()
+			// peer overran the window. Reset is sent aside, as readLoop must not block on the writer.
+			self.fail(ErrMuxStreamClosed)
+			self.session.remove(self.id)
+			go self.session.writeFrame(muxFrameReset, 0, self.id, nil)
+			return
+		}
+
+		self.recvAvailable -= len(payload)
+		if !self.readClosed {
+			self.buf = append(self.buf, payload...)
+		}
+	case muxFrameClose:
+		self.remoteClosed = true
+	case muxFrameReset:
+		if self.err == nil {
+			self.err = ErrMuxStreamReset
+		}
+	case muxFrameWindow:
+		if len(payload) == 4 {
+			self.sendWindow += int(binary.BigEndian.Uint32(payload))
+		}
+	}
+
+	done := self.err != nil || (self.remoteClosed && self.localClosed)
+	self.mu.Unlock()
+	self.cond.Broadcast()
+
+	if done {
+		self.session.remove(self.id)
+	}
+}
+
+func (self *MuxStream) Read(p []byte) (n int, err error) {
+	self.mu.Lock()
+
+	for len(self.buf) == 0 && !self.remoteClosed && self.err == nil {
+		self.cond.Wait()
+	}
+
+	if len(self.buf) == 0 {
+		err = self.err
+		if err == nil {
+			err = io.EOF
+		}
+		self.mu.Unlock()
+		return
+	}
+
+	n = copy(p, self.buf)
+	self.buf = self.buf[n:]
+	if len(self.buf) == 0 {
+		self.buf = nil
+	}
+
+	self.recvConsumed += n
+	update := 0
+	if self.recvConsumed >= muxInitialWindow/2 && !self.remoteClosed && self.err == nil {
+		update = self.recvConsumed
+		self.recvConsumed = 0
+		self.recvAvailable += update
+	}
+	self.mu.Unlock()
+
+	if update > 0 {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], uint32(update))
+		self.session.writeFrame(muxFrameWindow, 0, self.id, payload[:])
+	}
+
+	return
+}
+
+func (self *MuxStream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		self.mu.Lock()
+		for self.sendWindow == 0 && self.err == nil && !self.localClosed {
+			self.cond.Wait()
+		}
+
+		if self.err != nil {
+			err = self.err
+		} else if self.localClosed {
+			err = ErrMuxStreamClosed
+		}
+
+		if err != nil {
+			self.mu.Unlock()
+			return
+		}
+
+		chunk := min(len(p), self.sendWindow, muxMaxFrameSize)
+		self.sendWindow -= chunk
+		self.mu.Unlock()
+
+		if err = self.session.writeFrame(muxFrameData, 0, self.id, p[:chunk]); err != nil {
+			return
+		}
+
+		n += chunk
+		p = p[chunk:]
+	}
+
+	return
+}
+
+// CloseWrite tells the peer no more data will be sent
+func (self *MuxStream) CloseWrite() error {
+	self.mu.Lock()
+	if self.localClosed || self.err != nil {
+		self.mu.Unlock()
+		return nil
+	}
+
+	self.localClosed = true
+	done := self.remoteClosed
+	self.mu.Unlock()
+	self.cond.Broadcast()
+
+	err := self.session.writeFrame(muxFrameClose, 0, self.id, nil)
+
+	if done {
+		self.session.remove(self.id)
+	}
+	return err
+}
+
+// Close ends both directions. The stream is reset if the peer is still sending.
+func (self *MuxStream) Close() error {
+	self.mu.Lock()
+	self.readClosed = true
+	self.buf = nil
+	remoteClosed, err := self.remoteClosed, self.err
+	self.mu.Unlock()
+
+	if err != nil {
+		self.session.remove(self.id)
+		return nil
+	}
+
+	if !remoteClosed {
+		return self.Reset()
+	}
+
+	return self.CloseWrite()
+}
+
+// Reset aborts the stream in both directions
+func (self *MuxStream) Reset() error {
+	self.fail(ErrMuxStreamClosed)
+	self.session.remove(self.id)
+	return self.session.writeFrame(muxFrameReset, 0, self.id, nil)
+}
+
+// MuxConn is a logical connection of a mux session
+type MuxConn struct {
+	Reader
+	Writer
+	stream *MuxStream
+}
+
+func (self *MuxConn) Reset() error {
+	return self.stream.Reset()
+}
+
+func (self *MuxConn) CloseWrite() error {
+	err := self.Writer.Flush()
+	if err != nil {
+		return err
+	}
+	return self.stream.CloseWrite()
+}
+
+func (self *MuxConn) Close() error {
+	err := self.Writer.Flush()
+	if err != nil {
+		self.stream.Reset()
+		return err
+	}
+	return self.stream.Close()
+}
+
+func (self *MuxConn) RawReader() io.Reader {
+	if r, ok := self.Reader.(*ReaderImpl); ok {
+		return r.Unread(self.stream)
+	}
+
+	return self.stream
+}
+
+func (self *MuxConn) ReadFrom(r io.Reader) (n int64, err error) {
+	if err = self.Writer.Flush(); err != nil {
+		return
+	}
+	return io.Copy(self.stream, r)
+}
@@ -0,0 +1,204 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+var ErrOcspMalformed = errors.New("Malformed OCSP response")
+var ErrOcspNoResponse = errors.New("OCSP response is not for the certificate")
+var ErrOcspNoIssuer = errors.New("OCSP response cannot be verified without the issuer of the certificate")
+var ErrOcspBadSignature = errors.New("OCSP response is not signed by the issuer of the certificate or its responder")
+
+var oidOcspBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+var ocspHashes = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+}
+
+var ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+	"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+	"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+	"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+	"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+	"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+	"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+	"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+	"1.3.101.112":           x509.PureEd25519,
+}
+
+// OCSP response structures of RFC 6960 section 4.2.1, down to the single responses
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    ocspResponseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Raw                asn1.RawContent
+	Version            int `asn1:"optional,default:0,explicit,tag:0"`
+	RawResponderID     asn1.RawValue
+	ProducedAt         time.Time `asn1:"generalized"`
+	Responses          []ocspSingleResponse
+	ResponseExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type subjectPublicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspSingleResponse struct {
+	CertID           ocspCertID
+	Good             asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked          ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown          asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate       time.Time        `asn1:"generalized"`
+	NextUpdate       time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	SingleExtensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+// CheckOCSPStaple checks that the DER encoded OCSP response der is signed by issuer, or a responder issuer delegated
+// to, and reports leaf good at now. It returns when the response stops being current, or zero time if never.
+func CheckOCSPStaple(der []byte, leaf *x509.Certificate, issuer *x509.Certificate, now time.Time) (nextUpdate time.Time, err error) {
+	if issuer == nil {
+		return nextUpdate, ErrOcspNoIssuer
+	}
+
+	var resp ocspResponse
+	if rest, e := asn1.Unmarshal(der, &resp); e != nil || len(rest) > 0 {
+		return nextUpdate, ErrOcspMalformed
+	}
+
+	if resp.Status != 0 {
+		return nextUpdate, fmt.Errorf("OCSP response status %d is not successful", resp.Status)
+	}
+
+	if !resp.Response.ResponseType.Equal(oidOcspBasic) {
+		return nextUpdate, fmt.Errorf("OCSP response type %s is not supported", resp.Response.ResponseType)
+	}
+
+	var basic ocspBasicResponse
+	if rest, e := asn1.Unmarshal(resp.Response.Response, &basic); e != nil || len(rest) > 0 {
+		return nextUpdate, ErrOcspMalformed
+	}
+
+	if err = checkOcspSignature(&basic, issuer); err != nil {
+		return
+	}
+
+	var issuerKey subjectPublicKeyInfo
+	if _, e := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &issuerKey); e != nil {
+		return nextUpdate, ErrOcspMalformed
+	}
+
+	for _, single := range basic.TBSResponseData.Responses {
+		id := single.CertID
+		if id.SerialNumber == nil || id.SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+			continue
+		}
+
+		hash, ok := ocspHashes[id.HashAlgorithm.Algorithm.String()]
+		if !ok {
+			continue
+		}
+
+		// the issuer is named by the hashes of its name and its public key (RFC 6960 section 4.1.1)
+		h := hash.New()
+		h.Write(issuer.RawSubject)
+		if !bytes.Equal(h.Sum(nil), id.NameHash) {
+			continue
+		}
+
+		h.Reset()
+		h.Write(issuerKey.PublicKey.RightAlign())
+		if !bytes.Equal(h.Sum(nil), id.IssuerKeyHash) {
+			continue
+		}
+
+		switch {
+		case bool(single.Unknown):
+			return nextUpdate, fmt.Errorf("OCSP response reports certificate %s unknown", leaf.SerialNumber.Text(16))
+		case !bool(single.Good):
+			return nextUpdate, fmt.Errorf("OCSP response reports certificate %s revoked", leaf.SerialNumber.Text(16))
+		case now.Before(single.ThisUpdate):
+			return nextUpdate, fmt.Errorf("OCSP response is not valid until %s", single.ThisUpdate)
+		case !single.NextUpdate.IsZero() && !now.Before(single.NextUpdate):
+			return nextUpdate, fmt.Errorf("OCSP response expired at %s", single.NextUpdate)
+		}
+
+		return single.NextUpdate, nil
+	}
+
+	return nextUpdate, ErrOcspNoResponse
+}
+
+// checkOcspSignature verifies the signature of basic by issuer, or by a certificate in basic which issuer signed
+// for OCSP signing (RFC 6960 section 4.2.2.2)
+func checkOcspSignature(basic *ocspBasicResponse, issuer *x509.Certificate) error {
+	algorithm, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("OCSP signature algorithm %s is not supported", basic.SignatureAlgorithm.Algorithm)
+	}
+
+	signed, signature := basic.TBSResponseData.Raw, basic.Signature.RightAlign()
+	if issuer.CheckSignature(algorithm, signed, signature) == nil {
+		return nil
+	}
+
+	for _, raw := range basic.Certificates {
+		responder, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil || responder.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+
+		delegated := false
+		for _, usage := range responder.ExtKeyUsage {
+			delegated = delegated || usage == x509.ExtKeyUsageOCSPSigning
+		}
+
+		if delegated && responder.CheckSignature(algorithm, signed, signature) == nil {
+			return nil
+		}
+	}
+
+	return ErrOcspBadSignature
+}
@@ -0,0 +1,137 @@
+package tcp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket shared by any number of connections.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing bytesPerSecond on average, with bursts up to one second worth of bytes
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n tokens from the bucket, and blocks until the bucket is no longer in debt
+func (self *RateLimiter) Wait(n int) {
+	self.mu.Lock()
+	now := time.Now()
+	self.tokens += now.Sub(self.last).Seconds() * self.rate
+	if self.tokens > self.burst {
+		self.tokens = self.burst
+	}
+	self.last = now
+	self.tokens -= float64(n)
+	debt := self.tokens
+	self.mu.Unlock()
+
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / self.rate * float64(time.Second)))
+	}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *RateLimiter
+}
+
+func (self *limitedReader) Read(p []byte) (n int, err error) {
+	if len(p) > int(self.limiter.burst) {
+		p = p[:int(self.limiter.burst)]
+	}
+
+	n, err = self.reader.Read(p)
+	if n > 0 {
+		self.limiter.Wait(n)
+	}
+	return
+}
+
+// Reader returns a reader throttled by the limiter
+func (self *RateLimiter) Reader(r io.Reader) io.Reader {
+	return &limitedReader{
+		reader:  r,
+		limiter: self,
+	}
+}
+
+type throttledConn struct {
+	Conn
+	limiter *RateLimiter
+}
+
+func (self *throttledConn) Read(p []byte) (n int, err error) {
+	n, err = self.Conn.Read(p)
+	if n > 0 {
+		self.limiter.Wait(n)
+	}
+	return
+}
+
+func (self *throttledConn) ReadFull(p []byte) (n int, err error) {
+	n, err = self.Conn.ReadFull(p)
+	if n > 0 {
+		self.limiter.Wait(n)
+	}
+	return
+}
+
+func (self *throttledConn) ReadSlice(delim byte, p *[]byte) (b []byte, err error) {
+	b, err = self.Conn.ReadSlice(delim, p)
+	if len(b) > 0 {
+		self.limiter.Wait(len(b))
+	}
+	return
+}
+
+func (self *throttledConn) ReadAll(p *[]byte) (b []byte, err error) {
+	b, err = self.Conn.ReadAll(p)
+	if len(b) > 0 {
+		self.limiter.Wait(len(b))
+	}
+	return
+}
+
+func (self *throttledConn) Write(p []byte) (n int, err error) {
+	self.limiter.Wait(len(p))
+	return self.Conn.Write(p)
+}
+
+func (self *throttledConn) WriteAll(p ...[]byte) (n int, err error) {
+	l := 0
+	for _, b := range p {
+		l += len(b)
+	}
+
+	self.limiter.Wait(l)
+	return self.Conn.WriteAll(p...)
+}
+
+func (self *throttledConn) RawReader() io.Reader {
+	return self.limiter.Reader(self.Conn.RawReader())
+}
+
+func (self *throttledConn) ReadFrom(r io.Reader) (n int64, err error) {
+	return self.Conn.ReadFrom(self.limiter.Reader(r))
+}
+
+// Throttle limits bytes read from and written to conn with limiter
+func Throttle(conn Conn, limiter *RateLimiter) Conn {
+	return &throttledConn{
+		Conn:    conn,
+		limiter: limiter,
+	}
+}
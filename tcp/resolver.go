@@ -0,0 +1,376 @@
+package tcp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/z-george-ma/buggy/v2/dns"
+)
+
+var ErrDnsResponseMismatch = errors.New("DNS response does not match query")
+
+// InspectFunc checks the IPs host resolved to before any is dialed, e.g. against a destination policy, and
+// returns those allowed to dial on port, in order of preference
+type InspectFunc func(host string, port int, ips []net.IP) ([]net.IP, error)
+
+type resolverEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// Resolver resolves host names for TcpDialer. Names are looked up in Hosts, then the cache, then Servers.
+// Answers are cached for their TTL, and names not found for the TTL of the SOA record of the response.
+type Resolver struct {
+	// Servers are host:port of DNS servers, queried in turn over UDP, and over TCP for truncated responses.
+	// Empty to use the system resolver.
+	Servers []string
+	// Hosts overrides resolution of names, e.g. loaded by LoadHosts
+	Hosts map[string][]net.IP
+	// Timeout limits each query to a server, and lookups by the system resolver. 0 for no limit.
+	Timeout time.Duration
+	// MaxTTL caps the time answers are cached. Answers of the system resolver carry no TTL, and are cached for MaxTTL.
+	MaxTTL time.Duration
+	// NegativeTTL caps the time names not found are cached
+	NegativeTTL time.Duration
+	// Dialer queries Servers, or the servers of the system resolver, with its source address and socket options,
+	// e.g. the Dialer of TcpDialer. Nil for defaults.
+	Dialer *net.Dialer
+
+	mu    sync.Mutex
+	size  int
+	cache map[string]*resolverEntry
+}
+
+// NewResolver returns a resolver caching up to cacheSize names, or none if 0
+func NewResolver(cacheSize int) *Resolver {
+	return &Resolver{
+		size:  cacheSize,
+		cache: map[string]*resolverEntry{},
+	}
+}
+
+// LoadHosts loads a hosts file, where each line is an IP followed by the names it is for, e.g.
+//
+//	10.0.0.5 db.internal db
+func LoadHosts(file string) (map[string][]net.IP, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ret := map[string][]net.IP{}
+	scanner := bufio.NewScanner(f)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		ip := net.ParseIP(fields[0])
+		if ip == nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: malformed hosts entry", file, lineNo)
+		}
+
+		for _, name := range fields[1:] {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			ret[name] = append(ret[name], ip)
+		}
+	}
+
+	return ret, scanner.Err()
+}
+
+// LookupIP returns the IPs of host
+func (self *Resolver) LookupIP(ctx context.Context, host string) ([]net.IP, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ips, ok := self.Hosts[host]; ok {
+		return ips, nil
+	}
+
+	now := time.Now()
+	if entry := self.cached(host, now); entry != nil {
+		return entry.ips, entry.err
+	}
+
+	if self.Timeout > 0 {
+		// Servers are queried in turn, each within Timeout
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.Timeout*time.Duration(max(len(self.Servers), 1)))
+		defer cancel()
+	}
+
+	ips, ttl, err := self.lookup(ctx, host)
+
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+		ttl = min(ttl, self.MaxTTL)
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		ttl = min(ttl, self.NegativeTTL)
+	default:
+		// failures are not cached
+		ttl = 0
+	}
+
+	if ttl > 0 {
+		self.store(host, &resolverEntry{ips: ips, err: err, expires: now.Add(ttl)})
+	}
+
+	return ips, err
+}
+
+func (self *Resolver) cached(host string, now time.Time) *resolverEntry {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	entry := self.cache[host]
+	if entry != nil && !now.Before(entry.expires) {
+		delete(self.cache, host)
+		return nil
+	}
+	return entry
+}
+
+func (self *Resolver) store(host string, entry *resolverEntry) {
+	if self.size <= 0 {
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if _, ok := self.cache[host]; !ok && len(self.cache) >= self.size {
+		// drop expired entries, or else arbitrary ones
+		now := time.Now()
+		for h, e := range self.cache {
+			if !now.Before(e.expires) {
+				delete(self.cache, h)
+			}
+		}
+
+		for h := range self.cache {
+			if len(self.cache) < self.size {
+				break
+			}
+			delete(self.cache, h)
+		}
+	}
+
+	self.cache[host] = entry
+}
+
+// lookup resolves host by Servers, or the system resolver if none, and returns the time the answer may be cached
+func (self *Resolver) lookup(ctx context.Context, host string) (ips []net.IP, ttl time.Duration, err error) {
+	if len(self.Servers) == 0 {
+		ips, err = systemResolver(self.Dialer).LookupIP(ctx, "ip", host)
+		return ips, self.MaxTTL, err
+	}
+
+	type result struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+
+	types := []uint16{dns.TypeA, dns.TypeAAAA}
+	results := make([]result, len(types))
+
+	var wg sync.WaitGroup
+	for i, typ := range types {
+		wg.Add(1)
+		go func(i int, typ uint16) {
+			defer wg.Done()
+			r := &results[i]
+			r.ips, r.ttl, r.err = self.query(ctx, host, typ)
+		}(i, typ)
+	}
+	wg.Wait()
+
+	notFound, ttlSet := true, false
+	for _, r := range results {
+		ips = append(ips, r.ips...)
+		if !ttlSet || r.ttl < ttl {
+			ttl, ttlSet = r.ttl, true
+		}
+
+		var dnsErr *net.DNSError
+		if r.err != nil && !(errors.As(r.err, &dnsErr) && dnsErr.IsNotFound) {
+			notFound = false
+			err = r.err
+		}
+	}
+
+	switch {
+	case len(ips) > 0:
+		// answers of one type are enough, and are not cached longer than failures of the other are retried
+		if err != nil {
+			ttl = 0
+		}
+		return ips, ttl, nil
+	case err != nil:
+		return nil, 0, err
+	case notFound:
+		return nil, ttl, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return
+}
+
+// query asks Servers in turn for records of type typ of host
+func (self *Resolver) query(ctx context.Context, host string, typ uint16) (ips []net.IP, ttl time.Duration, err error) {
+	var id [2]byte
+	rand.Read(id[:])
+
+	query, err := dns.NewQuery(binary.BigEndian.Uint16(id[:]), host, typ)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	for _, server := range self.Servers {
+		var response []byte
+		if response, err = self.exchange(ctx, server, query); err != nil {
+			var netErr net.Error
+			err = &net.DNSError{Err: err.Error(), Name: host, Server: server, IsTimeout: errors.As(err, &netErr) && netErr.Timeout()}
+			continue
+		}
+
+		if seconds, ok, _ := dns.MinTTL(response); ok {
+			ttl = time.Duration(seconds) * time.Second
+		}
+
+		switch dns.Rcode(response) {
+		case dns.RcodeNameError:
+			return nil, ttl, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+		case dns.RcodeSuccess:
+		default:
+			err = &net.DNSError{Err: fmt.Sprintf("server failure, rcode %d", dns.Rcode(response)), Name: host, Server: server}
+			continue
+		}
+
+		dns.Records(response, func(r *dns.Record) bool {
+			if r.Section == 1 && r.Type == typ && (len(r.Data) == net.IPv4len || len(r.Data) == net.IPv6len) {
+				ips = append(ips, append(net.IP{}, r.Data...))
+			}
+			return true
+		})
+
+		if len(ips) == 0 {
+			// no records of typ
+			return nil, ttl, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+		}
+
+		return ips, ttl, nil
+	}
+
+	return
+}
+
+// exchange sends query to server over UDP, or TCP if the response is truncated, and returns the response
+func (self *Resolver) exchange(ctx context.Context, server string, query []byte) (response []byte, err error) {
+	if self.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.Timeout)
+		defer cancel()
+	}
+
+	for _, network := range []string{"udp", "tcp"} {
+		if response, err = self.exchangeOver(ctx, network, server, query); err != nil {
+			return
+		}
+
+		if !dns.Truncated(response) {
+			break
+		}
+	}
+
+	return
+}
+
+func (self *Resolver) exchangeOver(ctx context.Context, network string, server string, query []byte) (response []byte, err error) {
+	conn, err := dialerFor(self.Dialer, network).DialContext(ctx, network, server)
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	q, _, _ := dns.ParseQuestion(query)
+
+	if network == "tcp" {
+		if err = dns.WriteTcp(conn, query); err != nil {
+			return
+		}
+		if response, err = dns.ReadTcp(conn); err != nil {
+			return
+		}
+	} else {
+		if _, err = conn.Write(query); err != nil {
+			return
+		}
+
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			var n int
+			if n, err = conn.Read(buf); err != nil {
+				return
+			}
+
+			// datagrams not answering query, e.g. spoofed, are ignored
+			if rq, _, e := dns.ParseQuestion(buf[:n]); e == nil && rq == q && dns.ID(buf) == dns.ID(query) {
+				return buf[:n], nil
+			}
+		}
+	}
+
+	if rq, _, e := dns.ParseQuestion(response); e != nil || rq != q || dns.ID(response) != dns.ID(query) {
+		return nil, ErrDnsResponseMismatch
+	}
+
+	return
+}
+
+// dialerFor returns a copy of dialer, or a default one if nil, with the source address of the type network takes
+func dialerFor(dialer *net.Dialer, network string) *net.Dialer {
+	var ret net.Dialer
+	if dialer != nil {
+		ret = *dialer
+	}
+
+	if local, ok := ret.LocalAddr.(*net.TCPAddr); ok && local != nil && strings.HasPrefix(network, "udp") {
+		ret.LocalAddr = &net.UDPAddr{IP: local.IP, Zone: local.Zone}
+	}
+	return &ret
+}
+
+// systemResolver returns the system resolver, which queries the servers of /etc/resolv.conf with the source
+// address and socket options of dialer, if any
+func systemResolver(dialer *net.Dialer) *net.Resolver {
+	if dialer == nil || (dialer.LocalAddr == nil && dialer.Control == nil && dialer.ControlContext == nil) {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dialerFor(dialer, network).DialContext(ctx, network, address)
+		},
+	}
+}
@@ -4,11 +4,21 @@ import (
 	"context"
 	"errors"
 	"net"
+	"sync"
 	"time"
 )
 
+// ServerHooks are called on connection events, e.g. to collect metrics. They must not block.
+type ServerHooks struct {
+	// Accepted is called before the connection is handed to OnConnect
+	Accepted func(conn *TcpConn)
+	// Closed is called after OnConnect returns
+	Closed func(conn *TcpConn)
+}
+
 type TcpServer struct {
 	ListenConfig  *net.ListenConfig
+	Hooks         ServerHooks
 	tcpNoDelay    bool
 	listener      *net.TCPListener
 	onConnect     func(context.Context, *TcpConn)
@@ -17,6 +27,9 @@ type TcpServer struct {
 	writerBufSize int
 	loopCancel    context.CancelFunc
 	loopEnded     chan struct{}
+	connMu        sync.Mutex
+	conns         map[*TcpConn]struct{}
+	connWg        sync.WaitGroup
 }
 
 func NewServer(tcpNoDelay bool, readerBufSize, writerBufSize int, onAcceptError func(error) bool) *TcpServer {
@@ -27,6 +40,7 @@ func NewServer(tcpNoDelay bool, readerBufSize, writerBufSize int, onAcceptError
 		readerBufSize: readerBufSize,
 		writerBufSize: writerBufSize,
 		loopEnded:     make(chan struct{}),
+		conns:         map[*TcpConn]struct{}{},
 	}
 }
 
@@ -53,7 +67,8 @@ func (self *TcpServer) loop(ctx context.Context) {
 				}
 			}
 
-			go self.onConnect(ctx, &TcpConn{
+			self.connWg.Add(1)
+			go self.serve(ctx, &TcpConn{
 				Reader:  NewReader(conn, self.readerBufSize),
 				Writer:  NewWriter(conn, self.writerBufSize),
 				TCPConn: conn,
@@ -62,6 +77,77 @@ func (self *TcpServer) loop(ctx context.Context) {
 	}
 }
 
+func (self *TcpServer) serve(ctx context.Context, conn *TcpConn) {
+	defer self.connWg.Done()
+
+	self.connMu.Lock()
+	self.conns[conn] = struct{}{}
+	self.connMu.Unlock()
+
+	defer func() {
+		self.connMu.Lock()
+		delete(self.conns, conn)
+		self.connMu.Unlock()
+	}()
+
+	if self.Hooks.Accepted != nil {
+		self.Hooks.Accepted(conn)
+	}
+
+	if self.Hooks.Closed != nil {
+		defer self.Hooks.Closed(conn)
+	}
+
+	self.onConnect(ctx, conn)
+}
+
+// NumConns returns the number of live connections
+func (self *TcpServer) NumConns() int {
+	self.connMu.Lock()
+	defer self.connMu.Unlock()
+	return len(self.conns)
+}
+
+// Shutdown stops accepting connections, and waits for live connections to end until ctx is done.
+// Connections still live by then are reset. Returns the number of connections reset.
+// progress, if not nil, is called with the number of live connections every interval.
+func (self *TcpServer) Shutdown(ctx context.Context, interval time.Duration, progress func(live int)) (reset int) {
+	self.Close(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		self.connWg.Wait()
+		close(done)
+	}()
+
+	var tick <-chan time.Time
+	if progress != nil && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-tick:
+			progress(self.NumConns())
+		case <-ctx.Done():
+			self.connMu.Lock()
+			for conn := range self.conns {
+				conn.Reset()
+				reset++
+			}
+			self.connMu.Unlock()
+
+			<-done
+			return
+		}
+	}
+}
+
+// Close stops accepting connections. Live connections are left running, and see ctx given to OnConnect done.
 func (self *TcpServer) Close(ctx context.Context) {
 	if self.loopCancel == nil {
 		return
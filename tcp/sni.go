@@ -0,0 +1,180 @@
+package tcp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+var ErrNotTls = errors.New("Not a TLS handshake")
+var ErrMalformedClientHello = errors.New("Malformed TLS ClientHello")
+var ErrNotBuffered = errors.New("Connection does not read through a buffer")
+
+const (
+	tlsRecordHeaderSize = 5
+	tlsRecordHandshake  = 0x16
+	tlsHandshakeHello   = 0x01
+	tlsMaxRecordSize    = 16384 + 2048
+	tlsExtensionSni     = 0
+	tlsSniHostNameType  = 0
+	maxClientHelloSize  = tlsRecordHeaderSize + tlsMaxRecordSize
+)
+
+// PeekClientHello reads the first TLS record of conn, and returns the server name of the ClientHello in it,
+// or empty string if none. hello holds all bytes read, to be replayed to whoever handles the connection next,
+// which is set even when err is not nil.
+func PeekClientHello(conn *TcpConn) (hello []byte, serverName string, err error) {
+	conn.Reader.SetSnapshot(nil, maxClientHelloSize)
+	defer func() {
+		hello = conn.Reader.GetSnapshot(true)
+	}()
+
+	var header [tlsRecordHeaderSize]byte
+	if _, err = conn.Reader.ReadFull(header[:]); err != nil {
+		return
+	}
+
+	if header[0] != tlsRecordHandshake {
+		err = ErrNotTls
+		return
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:]))
+	if length > tlsMaxRecordSize {
+		err = ErrMalformedClientHello
+		return
+	}
+
+	record := make([]byte, length)
+	if _, err = conn.Reader.ReadFull(record); err != nil {
+		return
+	}
+
+	serverName, err = parseServerName(record)
+	return
+}
+
+// IsTlsHandshake tells if the bytes waiting on conn start a TLS handshake record, without consuming them.
+// conn must read through a buffer.
+func IsTlsHandshake(conn *TcpConn) (bool, error) {
+	r, ok := conn.Reader.(*ReaderImpl)
+	if !ok || r.buf == nil {
+		return false, ErrNotBuffered
+	}
+
+	b, err := r.buf.Peek(1)
+	if err != nil {
+		return false, err
+	}
+
+	return b[0] == tlsRecordHandshake, nil
+}
+
+// readVector reads a vector prefixed by its length of size bytes
+func readVector(p []byte, size int) (vector []byte, rest []byte, ok bool) {
+	if len(p) < size {
+		return nil, nil, false
+	}
+
+	length := 0
+	for _, b := range p[:size] {
+		length = length<<8 | int(b)
+	}
+
+	p = p[size:]
+	if len(p) < length {
+		return nil, nil, false
+	}
+
+	return p[:length], p[length:], true
+}
+
+// parseServerName returns the server_name extension of the ClientHello handshake message in record.
+// A ClientHello split over several records is not supported.
+func parseServerName(record []byte) (string, error) {
+	// handshake type(1) length(3) version(2) random(32)
+	if len(record) < 38 || record[0] != tlsHandshakeHello {
+		return "", ErrMalformedClientHello
+	}
+
+	p := record[38:]
+	var ok bool
+
+	// session id, cipher suites, compression methods
+	for _, size := range []int{1, 2, 1} {
+		if _, p, ok = readVector(p, size); !ok {
+			return "", ErrMalformedClientHello
+		}
+	}
+
+	if len(p) == 0 {
+		// no extensions
+		return "", nil
+	}
+
+	extensions, _, ok := readVector(p, 2)
+	if !ok {
+		return "", ErrMalformedClientHello
+	}
+
+	for len(extensions) >= 4 {
+		typ := binary.BigEndian.Uint16(extensions)
+		var data []byte
+		if data, extensions, ok = readVector(extensions[2:], 2); !ok {
+			return "", ErrMalformedClientHello
+		}
+
+		if typ != tlsExtensionSni {
+			continue
+		}
+
+		names, _, ok := readVector(data, 2)
+		for ok && len(names) > 0 {
+			nameType := names[0]
+			var name []byte
+			if name, names, ok = readVector(names[1:], 2); ok && nameType == tlsSniHostNameType {
+				return string(name), nil
+			}
+		}
+
+		return "", ErrMalformedClientHello
+	}
+
+	return "", nil
+}
+
+// replayConn reads replayed bytes first, then from the underlying connection
+type replayConn struct {
+	*net.TCPConn
+	reader io.Reader
+}
+
+func (self *replayConn) Read(p []byte) (int, error) {
+	return self.reader.Read(p)
+}
+
+// TlsBindReplay binds TLS server side on conn, after some bytes were read off it, e.g. by PeekClientHello.
+// replay is fed to the TLS handshake ahead of the rest of conn.
+func TlsBindReplay(conn *TcpConn, replay []byte, config *tls.Config) *TlsConn {
+	pending := replay
+	if r, ok := conn.Reader.(*ReaderImpl); ok && r.buf != nil && r.buf.Buffered() > 0 {
+		// bytes buffered by the reader are dropped when it is reset onto the TLS connection
+		buffered, _ := r.buf.Peek(r.buf.Buffered())
+		pending = append(append([]byte{}, replay...), buffered...)
+	}
+
+	c := tls.Server(&replayConn{
+		TCPConn: conn.TCPConn,
+		reader:  io.MultiReader(bytes.NewReader(pending), conn.TCPConn),
+	}, config)
+	conn.Reader.(*ReaderImpl).Reset(c)
+	conn.Writer.(*WriterImpl).Reset(c)
+	return &TlsConn{
+		Reader: conn.Reader,
+		Writer: conn.Writer,
+		Conn:   c,
+	}
+}
@@ -0,0 +1,74 @@
+package tcp
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// StdioConn is a Conn over a pair of files, e.g. stdin and stdout of a ProxyCommand.
+// CloseWrite closes out, leaving in open for reading.
+type StdioConn struct {
+	Reader
+	Writer
+	in  *os.File
+	out *os.File
+}
+
+func NewStdioConn(in *os.File, out *os.File, readerBufSize int, writerBufSize int) *StdioConn {
+	return &StdioConn{
+		Reader: NewReader(in, readerBufSize),
+		Writer: NewWriter(out, writerBufSize),
+		in:     in,
+		out:    out,
+	}
+}
+
+// closeFile closes f, ignoring it being closed already by CloseWrite
+func closeFile(f *os.File) error {
+	if err := f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+// Reset closes both files without flushing
+func (self *StdioConn) Reset() error {
+	err := closeFile(self.out)
+	if e := closeFile(self.in); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (self *StdioConn) CloseWrite() error {
+	err := self.Writer.Flush()
+	if err != nil {
+		return err
+	}
+	return closeFile(self.out)
+}
+
+func (self *StdioConn) Close() error {
+	err := self.Writer.Flush()
+	if err != nil && !errors.Is(err, os.ErrClosed) {
+		self.Reset()
+		return err
+	}
+	return self.Reset()
+}
+
+func (self *StdioConn) RawReader() io.Reader {
+	if r, ok := self.Reader.(*ReaderImpl); ok {
+		return r.Unread(self.in)
+	}
+
+	return self.in
+}
+
+func (self *StdioConn) ReadFrom(r io.Reader) (n int64, err error) {
+	if err = self.Writer.Flush(); err != nil {
+		return
+	}
+	return io.Copy(self.out, r)
+}
@@ -37,5 +37,9 @@ func (self *TcpConn) Close() error {
 }
 
 func (self *TcpConn) RawReader() io.Reader {
+	if r, ok := self.Reader.(*ReaderImpl); ok {
+		return r.Unread(self.TCPConn)
+	}
+
 	return self.TCPConn
 }
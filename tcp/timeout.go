@@ -0,0 +1,183 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TimeoutError tells which timeout fired. It implements net.Error.
+type TimeoutError struct {
+	msg string
+}
+
+func (self *TimeoutError) Error() string   { return self.msg }
+func (self *TimeoutError) Timeout() bool   { return true }
+func (self *TimeoutError) Temporary() bool { return false }
+
+var ErrHandshakeTimeout = &TimeoutError{"TLS handshake timeout"}
+var ErrHeaderTimeout = &TimeoutError{"Header read timeout"}
+var ErrIdleTimeout = &TimeoutError{"Idle timeout"}
+var ErrLifetimeExceeded = &TimeoutError{"Max connection lifetime exceeded"}
+
+// SpliceOptions limits how long Splice keeps connections open. 0 for no limit.
+type SpliceOptions struct {
+	// IdleTimeout tears down both connections if no byte flows in either direction for the duration
+	IdleTimeout time.Duration
+	// MaxLifetime tears down both connections after the duration
+	MaxLifetime time.Duration
+}
+
+// HandshakeTimeout runs TLS handshake, which fails with ErrHandshakeTimeout if not complete within timeout.
+func (self *TlsConn) HandshakeTimeout(timeout time.Duration) error {
+	if timeout <= 0 {
+		return self.Conn.Handshake()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := self.Conn.HandshakeContext(ctx)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ErrHandshakeTimeout
+	}
+	return err
+}
+
+// RunWithTimeout runs fn, and resets conn if fn does not complete within timeout.
+// err is returned as the error if the timeout fires.
+func RunWithTimeout(conn Conn, timeout time.Duration, err error, fn func() error) error {
+	if timeout <= 0 {
+		return fn()
+	}
+
+	fired := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		defer close(fired)
+		conn.Reset()
+	})
+
+	ret := fn()
+	if !timer.Stop() {
+		// conn is being reset, wait for it so that the caller does not race with it
+		<-fired
+		return err
+	}
+	return ret
+}
+
+// spliceWatchdog tears down both sides of a splice when idle timeout or lifetime is reached
+type spliceWatchdog struct {
+	options    SpliceOptions
+	dst        Conn
+	src        Conn
+	lastActive atomic.Int64
+	done       chan struct{}
+	stopOnce   sync.Once
+	mu         sync.Mutex
+	err        error
+}
+
+type activityReader struct {
+	reader   io.Reader
+	watchdog *spliceWatchdog
+}
+
+func (self *activityReader) Read(p []byte) (n int, err error) {
+	n, err = self.reader.Read(p)
+	if n > 0 {
+		self.watchdog.lastActive.Store(time.Now().UnixNano())
+	}
+	return
+}
+
+func newSpliceWatchdog(dst Conn, src Conn, options SpliceOptions) *spliceWatchdog {
+	ret := &spliceWatchdog{
+		options: options,
+		dst:     dst,
+		src:     src,
+		done:    make(chan struct{}),
+	}
+
+	ret.lastActive.Store(time.Now().UnixNano())
+	go ret.loop()
+	return ret
+}
+
+func (self *spliceWatchdog) loop() {
+	start := time.Now()
+	deadline := start.Add(self.options.MaxLifetime)
+
+	for {
+		now := time.Now()
+		wait := time.Duration(-1)
+
+		if self.options.MaxLifetime > 0 {
+			wait = deadline.Sub(now)
+			if wait <= 0 {
+				self.fire(ErrLifetimeExceeded)
+				return
+			}
+		}
+
+		if self.options.IdleTimeout > 0 {
+			idle := time.Unix(0, self.lastActive.Load()).Add(self.options.IdleTimeout).Sub(now)
+			if idle <= 0 {
+				self.fire(ErrIdleTimeout)
+				return
+			}
+
+			if wait < 0 || idle < wait {
+				wait = idle
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-self.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (self *spliceWatchdog) fire(err error) {
+	self.mu.Lock()
+	self.err = err
+	self.mu.Unlock()
+
+	self.dst.Reset()
+	self.src.Reset()
+}
+
+func (self *spliceWatchdog) stop() {
+	self.stopOnce.Do(func() {
+		close(self.done)
+	})
+}
+
+// result replaces err with the timeout that fired, if any
+func (self *spliceWatchdog) result(err error) error {
+	if self == nil {
+		return err
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.err != nil {
+		return self.err
+	}
+	return err
+}
+
+func (self *spliceWatchdog) reader(r io.Reader) io.Reader {
+	return &activityReader{
+		reader:   r,
+		watchdog: self,
+	}
+}
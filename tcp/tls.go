@@ -2,8 +2,11 @@ package tcp
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"io"
 	"net"
+	"syscall"
 )
 
 type TlsConn struct {
@@ -20,11 +23,16 @@ func (self *TlsConn) Write(p []byte) (n int, err error) {
 	return self.Writer.Write(p)
 }
 
+// lingerer is implemented by *net.TCPConn and connections wrapping it
+type lingerer interface {
+	SetLinger(sec int) error
+}
+
 func (self *TlsConn) Reset() error {
-	tcpConn := self.Conn.NetConn().(*net.TCPConn)
-	err := tcpConn.SetLinger(0)
-	if err != nil {
-		return err
+	if conn, ok := self.Conn.NetConn().(lingerer); ok {
+		if err := conn.SetLinger(0); err != nil {
+			return err
+		}
 	}
 	return self.Conn.Close()
 }
@@ -46,6 +54,10 @@ func (self *TlsConn) Close() error {
 }
 
 func (self *TlsConn) RawReader() io.Reader {
+	if r, ok := self.Reader.(*ReaderImpl); ok {
+		return r.Unread(self.Conn)
+	}
+
 	return self.Conn
 }
 
@@ -74,3 +86,33 @@ func TlsBind(conn *TcpConn, config *tls.Config) *TlsConn {
 		Conn:   c,
 	}
 }
+
+// HandshakeErrorClass classifies a TLS handshake error into a short label, e.g. for metrics
+func HandshakeErrorClass(err error) string {
+	var netErr net.Error
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var hostnameErr x509.HostnameError
+
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case err == io.EOF, err == io.ErrUnexpectedEOF, errors.Is(err, syscall.ECONNRESET):
+		return "eof"
+	case errors.As(err, &verifyErr), errors.As(err, &unknownAuthErr),
+		errors.As(err, &invalidErr), errors.As(err, &hostnameErr):
+		return "bad_certificate"
+	case errors.As(err, &alertErr):
+		return "alert"
+	case errors.As(err, &recordErr):
+		return "not_tls"
+	case err.Error() == "tls: client didn't provide a certificate":
+		// crypto/tls does not export this error
+		return "no_certificate"
+	}
+
+	return "other"
+}
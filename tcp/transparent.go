@@ -0,0 +1,40 @@
+package tcp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+var ErrNoOriginalDst = errors.New("No original destination, connection was not redirected")
+var ErrTransparentUnsupported = errors.New("Transparent proxy is only supported on linux")
+
+// IsListenerAddr tells if dst is an address a listener on listenAddr, e.g. :12345, accepts connections on.
+// A transparent proxy connecting to it would connect back to itself.
+func IsListenerAddr(dst *net.TCPAddr, listenAddr string) bool {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil || port != strconv.Itoa(dst.Port) {
+		return false
+	}
+
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return ip.Equal(dst.IP)
+	}
+
+	// listening on all addresses, or a host name
+	if dst.IP.IsLoopback() || dst.IP.IsUnspecified() {
+		return true
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
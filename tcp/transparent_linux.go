@@ -0,0 +1,81 @@
+//go:build linux
+
+package tcp
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST of linux/netfilter_ipv4.h
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST of linux/netfilter_ipv6/ip6_tables.h
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT of linux/in6.h
+)
+
+// OriginalDst returns the destination of conn before it was redirected to this host by
+// iptables REDIRECT or DNAT, as recorded by conntrack.
+func OriginalDst(conn *net.TCPConn) (ret *net.TCPAddr, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	isIPv4 := conn.LocalAddr().(*net.TCPAddr).IP.To4() != nil
+
+	controlErr := raw.Control(func(fd uintptr) {
+		if isIPv4 {
+			// sockaddr_in fits in IPv6Mreq: family(2) port(2) addr(4) zero(8)
+			var mreq *syscall.IPv6Mreq
+			if mreq, err = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err == nil {
+				ret = &net.TCPAddr{
+					IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+					Port: int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3]),
+				}
+			}
+			return
+		}
+
+		// sockaddr_in6 is the head of IPv6MTUInfo
+		var info *syscall.IPv6MTUInfo
+		if info, err = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst); err == nil {
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			ret = &net.TCPAddr{
+				IP:   net.IP(append([]byte{}, info.Addr.Addr[:]...)),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+		}
+	})
+
+	if controlErr != nil {
+		return nil, controlErr
+	}
+
+	if err != nil {
+		return nil, ErrNoOriginalDst
+	}
+
+	return
+}
+
+// TransparentControl sets IP_TRANSPARENT on listening sockets, to accept connections for
+// any destination diverted by iptables TPROXY. Set as ListenConfig.Control. Requires CAP_NET_ADMIN.
+func TransparentControl(network, address string, c syscall.RawConn) error {
+	var err error
+	controlErr := c.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil {
+			return
+		}
+
+		if network == "tcp6" || network == "tcp" {
+			// dual stack sockets take IPv6 connections too, IPv4 only sockets fail harmlessly
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
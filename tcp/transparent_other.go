@@ -0,0 +1,16 @@
+//go:build !linux
+
+package tcp
+
+import (
+	"net"
+	"syscall"
+)
+
+func OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentUnsupported
+}
+
+func TransparentControl(network, address string, c syscall.RawConn) error {
+	return ErrTransparentUnsupported
+}